@@ -30,7 +30,11 @@
 
 package main
 
+import "context"
 import "log"
+import "net"
+import "strconv"
+import "time"
 
 import "github.com/docopt/docopt-go"
 
@@ -40,29 +44,92 @@ func main() {
     log.SetFlags(0)
 
     usage := `Usage: moodns-resolve [options] <name>
+       moodns-resolve [options] -x <addr>
 
 Options:
-  -6, --ipv6  Request IPv6 address too [default: false].
-  -h, --help  Show the program's help message and exit.`
+  -6, --ipv6                   Request IPv6 address too [default: false].
+  -a, --all                    Wait for the answers of all responders [default: false].
+  -t <sec>, --timeout <sec>    Wait at most this many seconds for answers [default: 3].
+  -r <num>, --retries <num>    Resend the query this many times if unanswered [default: 0].
+  -i <ifname>, --interface <ifname>  Send the query on the given interface.
+  -m <mode>, --mode <mode>     Query mode, "legacy" or "multicast" [default: legacy].
+  -x <addr>, --reverse <addr>  Resolve the name of the given address.
+  -h, --help                   Show the program's help message and exit.`
 
     args, err := docopt.Parse(usage, nil, true, "", false)
     if err != nil {
         log.Fatalf("Invalid arguments: %s", err)
     }
 
-    name := args["<name>"].(string)
+    client := new(mdns.Client)
+
+    timeout, err := strconv.ParseFloat(args["--timeout"].(string), 64)
+    if err != nil || timeout <= 0 {
+        log.Fatalf("Invalid timeout: %s", args["--timeout"])
+    }
+
+    client.Timeout = time.Duration(timeout * float64(time.Second))
+
+    client.Retries, err = strconv.Atoi(args["--retries"].(string))
+    if err != nil || client.Retries < 0 {
+        log.Fatalf("Invalid retries: %s", args["--retries"])
+    }
+
+    if args["--interface"] != nil {
+        client.Interface, err = net.InterfaceByName(args["--interface"].(string))
+        if err != nil {
+            log.Fatalf("Invalid interface: %s", err)
+        }
+    }
+
+    client.Mode, err = mdns.ParseMode(args["--mode"].(string))
+    if err != nil {
+        log.Fatalf("%s", err)
+    }
+
+    ctx := context.Background()
 
     req := new(mdns.Message)
 
-    qname := []byte(name + ".")
+    if args["--reverse"] != nil {
+        addr := args["--reverse"].(string)
+
+        ip := net.ParseIP(addr)
+        if ip == nil {
+            log.Fatalf("Invalid address: %s", addr)
+        }
+
+        qname := []byte(mdns.ReverseName(ip))
+
+        req.AppendQD(mdns.NewQD(qname, mdns.TypePTR, mdns.ClassInet))
+    } else {
+        name := args["<name>"].(string)
+
+        qname := []byte(name + ".")
+
+        req.AppendQD(mdns.NewQD(qname, mdns.TypeA, mdns.ClassInet))
+
+        if args["--ipv6"].(bool) {
+            req.AppendQD(mdns.NewQD(qname, mdns.TypeAAAA, mdns.ClassInet))
+        }
+    }
+
+    if args["--all"].(bool) {
+        rsp, responses, err := client.Gather(ctx, req)
+        if err != nil {
+            log.Fatalf("Error sending request: %s", err)
+        }
+
+        log.Println(rsp)
 
-    req.AppendQD(mdns.NewQD(qname, mdns.TypeA, mdns.ClassInet))
+        for _, r := range responses {
+            log.Printf(";; %d answers from %s", len(r.Records), r.From)
+        }
 
-    if args["--ipv6"].(bool) {
-        req.AppendQD(mdns.NewQD(qname, mdns.TypeAAAA, mdns.ClassInet))
+        return
     }
 
-    rsp, err := mdns.SendRequest(req)
+    rsp, err := client.Exchange(ctx, req)
     if err != nil {
         log.Fatalf("Error sending request: %s", err)
     }
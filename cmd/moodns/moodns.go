@@ -32,7 +32,10 @@ package main
 
 import "log"
 import "os"
+import "os/signal"
+import "reflect"
 import "strings"
+import "syscall"
 
 import "github.com/docopt/docopt-go"
 
@@ -45,7 +48,8 @@ func main() {
 
 Options:
   -H <hostname>, --host <hostname>      Name of the local host.
-  -l <addr:port>, --listen <addr:port>  Listen on this local address and port [default: 0.0.0.0:5353].
+  -l <addr:port>, --listen <addr:port>  Listen on this local address and port [default: :5353].
+  -d <dir>, --services <dir>            Load service definitions from this directory [default: /etc/moodns/services.d].
   -r, --enable-multicast-forward        Enable forwarding of unicast requests to multicast.
   -s, --silent                          Print fatal errors only.
   -h, --help                            Show the program's help message and exit.`
@@ -56,6 +60,7 @@ Options:
     }
 
     listen := args["--listen"].(string)
+    dir    := args["--services"].(string)
 
     hostname, _ := os.Hostname()
     if args["--host"] != nil {
@@ -66,14 +71,93 @@ Options:
     silent    := args["--silent"].(bool)
     forward   := args["--enable-multicast-forward"].(bool)
 
+    services := mdns.NewRegistry()
+
+    loaded := ReloadServices(services, nil, dir, silent)
+
+    var servers []*mdns.Server
+
     for _, addr := range strings.Split(listen, ",") {
-        maddr, server, err := mdns.NewServer(addr)
+        server, err := mdns.NewServer(addr)
         if err != nil {
             log.Fatalf("Error starting server: %s", err)
         }
 
-        go mdns.Serve(server, maddr, localname, silent, forward)
+        server.Name     = localname
+        server.Services = services
+        server.Silent   = silent
+        server.Forward  = forward
+
+        go server.Serve()
+
+        servers = append(servers, server)
+    }
+
+    sigs := make(chan os.Signal, 1)
+    signal.Notify(sigs, syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM)
+
+    for sig := range sigs {
+        if sig == syscall.SIGHUP {
+            loaded = ReloadServices(services, loaded, dir, silent)
+            continue
+        }
+
+        for _, server := range servers {
+            server.Close()
+        }
+
+        return
+    }
+}
+
+func ReloadServices(services *mdns.Registry, old []*mdns.Service, dir string, silent bool) []*mdns.Service {
+    var registered []*mdns.Service
+
+    loaded, errs := LoadServices(dir)
+
+    if silent != true {
+        for _, err := range errs {
+            log.Println("Error loading service: ", err)
+        }
+    }
+
+    /* only withdraw the services that actually changed, so that peers
+     * don't see the others go away and come back on every reload */
+    for _, s := range old {
+        if HasService(loaded, s) {
+            registered = append(registered, s)
+            continue
+        }
+
+        services.Deregister(s)
+    }
+
+    for _, s := range loaded {
+        if HasService(old, s) {
+            continue
+        }
+
+        err := services.Register(s)
+        if err != nil {
+            if silent != true {
+                log.Println("Error registering service: ", err)
+            }
+
+            continue
+        }
+
+        registered = append(registered, s)
+    }
+
+    return registered
+}
+
+func HasService(services []*mdns.Service, s *mdns.Service) bool {
+    for _, other := range services {
+        if reflect.DeepEqual(other, s) {
+            return true
+        }
     }
 
-    select {}
+    return false
 }
@@ -0,0 +1,137 @@
+/*
+ * Minimal multicast DNS server.
+ *
+ * Copyright (c) 2014, Alessandro Ghedini
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are
+ * met:
+ *
+ *     * Redistributions of source code must retain the above copyright
+ *       notice, this list of conditions and the following disclaimer.
+ *
+ *     * Redistributions in binary form must reproduce the above copyright
+ *       notice, this list of conditions and the following disclaimer in the
+ *       documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS
+ * IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO,
+ * THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR
+ * PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR
+ * CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL,
+ * EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+ * PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+ * PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF
+ * LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING
+ * NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+ * SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package main
+
+import "bufio"
+import "fmt"
+import "os"
+import "path/filepath"
+import "strconv"
+import "strings"
+
+import "github.com/ghedo/moodns/mdns"
+
+func LoadServices(dir string) ([]*mdns.Service, []error) {
+    var services []*mdns.Service
+    var errs     []error
+
+    files, err := filepath.Glob(filepath.Join(dir, "*.conf"))
+    if err != nil {
+        return nil, []error{ fmt.Errorf("Could not list '%s': %s", dir, err) }
+    }
+
+    for _, file := range files {
+        s, err := ParseServiceFile(file)
+        if err != nil {
+            errs = append(errs, err)
+            continue
+        }
+
+        services = append(services, s)
+    }
+
+    return services, errs
+}
+
+func ParseServiceFile(file string) (*mdns.Service, error) {
+    f, err := os.Open(file)
+    if err != nil {
+        return nil, fmt.Errorf("Could not open '%s': %s", file, err)
+    }
+    defer f.Close()
+
+    s := new(mdns.Service)
+
+    scanner := bufio.NewScanner(f)
+
+    for n := 1; scanner.Scan(); n++ {
+        line := strings.TrimSpace(scanner.Text())
+
+        if line == "" || strings.HasPrefix(line, "#") {
+            continue
+        }
+
+        kv := strings.SplitN(line, "=", 2)
+        if len(kv) != 2 {
+            return nil, fmt.Errorf("%s:%d: expected 'key = value'", file, n)
+        }
+
+        key   := strings.ToLower(strings.TrimSpace(kv[0]))
+        value := strings.TrimSpace(kv[1])
+
+        switch key {
+        case "name":
+            s.Instance = value
+
+        case "type":
+            s.Service = value
+
+        case "domain":
+            s.Domain = value
+
+        case "host":
+            s.Host = value
+
+        case "port":
+            port, err := strconv.ParseUint(value, 10, 16)
+            if err != nil {
+                return nil, fmt.Errorf("%s:%d: invalid port '%s'",
+                                       file, n, value)
+            }
+
+            s.Port = uint16(port)
+
+        case "txt":
+            s.Text = append(s.Text, value)
+
+        case "subtype":
+            s.Subtypes = append(s.Subtypes, value)
+
+        default:
+            return nil, fmt.Errorf("%s:%d: unknown key '%s'", file, n, key)
+        }
+    }
+
+    err = scanner.Err()
+    if err != nil {
+        return nil, fmt.Errorf("Could not read '%s': %s", file, err)
+    }
+
+    if s.Port == 0 {
+        return nil, fmt.Errorf("%s: missing port", file)
+    }
+
+    if s.Host != "" && strings.HasSuffix(s.Host, ".") != true {
+        s.Host += "."
+    }
+
+    return s, nil
+}
@@ -1,5 +1,7 @@
 module github.com/ghedo/moodns
 
+go 1.20
+
 require (
 	github.com/docopt/docopt-go v0.0.0-20180111231733-ee0de3bc6815
 	golang.org/x/net v0.0.0-20181213202711-891ebc4b82d6
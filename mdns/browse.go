@@ -0,0 +1,207 @@
+/*
+ * Minimal multicast DNS server.
+ *
+ * Copyright (c) 2014, Alessandro Ghedini
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are
+ * met:
+ *
+ *     * Redistributions of source code must retain the above copyright
+ *       notice, this list of conditions and the following disclaimer.
+ *
+ *     * Redistributions in binary form must reproduce the above copyright
+ *       notice, this list of conditions and the following disclaimer in the
+ *       documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS
+ * IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO,
+ * THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR
+ * PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR
+ * CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL,
+ * EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+ * PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+ * PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF
+ * LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING
+ * NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+ * SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package mdns
+
+import "context"
+import "net"
+import "time"
+
+const browseFirstWait = 1 * time.Second
+const browseMaxWait   = 60 * time.Minute
+
+type EventType int
+
+const (
+    EventAdd EventType = iota
+    EventRefresh
+    EventRemove
+)
+
+func (t EventType) String() string {
+    switch t {
+    case EventAdd:
+        return "add"
+
+    case EventRefresh:
+        return "refresh"
+
+    case EventRemove:
+        return "remove"
+
+    default:
+        return "unknown"
+    }
+}
+
+type Event struct {
+    Type   EventType
+    Record *Record
+    From   *net.UDPAddr
+}
+
+/* Keeps asking the given question and reports the records that answer it
+ * as they come and go, until the context is cancelled. Browsing listens on
+ * the multicast group, so announcements and goodbyes are reported as soon
+ * as they are sent. */
+func Browse(ctx context.Context, q *Question) (<-chan *Event, error) {
+    client := &Client{ Mode: ModeMulticast }
+
+    conn, err := client.Dial()
+    if err != nil {
+        return nil, err
+    }
+
+    events  := make(chan *Event)
+    packets := make(chan *packet)
+
+    go func() {
+        for {
+            pkt := ReadPacket(conn)
+
+            select {
+            case packets <- pkt:
+
+            case <-ctx.Done():
+                return
+            }
+        }
+    }()
+
+    go func() {
+        defer close(events)
+        defer conn.Close()
+
+        cache := NewCache()
+        cache.Interest(q)
+
+        wait := browseFirstWait
+
+        query := time.NewTimer(0)
+        defer query.Stop()
+
+        ticker := time.NewTicker(cacheTick)
+        defer ticker.Stop()
+
+        emit := func(t EventType, rr *Record, from *net.UDPAddr) bool {
+            select {
+            case events <- &Event{ Type: t, Record: rr, From: from }:
+                return true
+
+            case <-ctx.Done():
+                return false
+            }
+        }
+
+        for {
+            select {
+            case pkt := <-packets:
+                if pkt.err != nil || pkt.msg.Header.Flags & FlagQR == 0 {
+                    continue
+                }
+
+                /* RFC 6762 §6 */
+                if pkt.from.Port != 5353 {
+                    continue
+                }
+
+                now := time.Now()
+
+                for _, rr := range pkt.msg.Answer {
+                    added := cache.Insert(rr, now)
+
+                    /* goodbyes are reported once they expire */
+                    if q.Matches(rr) != true || rr.TTL == 0 {
+                        continue
+                    }
+
+                    t := EventRefresh
+                    if added {
+                        t = EventAdd
+                    }
+
+                    if emit(t, rr, pkt.from) != true {
+                        return
+                    }
+                }
+
+                for _, rr := range pkt.msg.Additional {
+                    cache.Insert(rr, now)
+                }
+
+            case <-query.C:
+                err := SendQuery(conn, q, cache)
+                if err != nil {
+                    return
+                }
+
+                query.Reset(wait)
+
+                wait *= 2
+                if wait > browseMaxWait {
+                    wait = browseMaxWait
+                }
+
+            case now := <-ticker.C:
+                for _, rr := range cache.Expire(now) {
+                    if q.Matches(rr) && emit(EventRemove, rr, nil) != true {
+                        return
+                    }
+                }
+
+                if len(cache.Maintain(now)) > 0 {
+                    err := SendQuery(conn, q, cache)
+                    if err != nil {
+                        return
+                    }
+                }
+
+            case <-ctx.Done():
+                return
+            }
+        }
+    }()
+
+    return events, nil
+}
+
+/* Sends the question along with the answers we already know about, so that
+ * responders don't repeat them. */
+func SendQuery(conn *Conn, q *Question, cache *Cache) error {
+    req := new(Message)
+
+    req.AppendQD(q)
+
+    for _, rr := range cache.Lookup(q.Name, q.Type, q.Class) {
+        req.AppendAN(rr)
+    }
+
+    return Write(conn, conn.Group, req)
+}
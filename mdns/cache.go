@@ -0,0 +1,308 @@
+/*
+ * Minimal multicast DNS server.
+ *
+ * Copyright (c) 2014, Alessandro Ghedini
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are
+ * met:
+ *
+ *     * Redistributions of source code must retain the above copyright
+ *       notice, this list of conditions and the following disclaimer.
+ *
+ *     * Redistributions in binary form must reproduce the above copyright
+ *       notice, this list of conditions and the following disclaimer in the
+ *       documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS
+ * IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO,
+ * THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR
+ * PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR
+ * CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL,
+ * EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+ * PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+ * PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF
+ * LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING
+ * NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+ * SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package mdns
+
+import "math/rand"
+import "strings"
+import "sync"
+import "time"
+
+const cacheTick      = 1 * time.Second
+const cacheFlushWait = 1 * time.Second
+const goodbyeTTL     = 1 * time.Second
+
+/* fractions of the TTL at which records of interest are re-queried, each
+ * one gets up to refreshJitter added, RFC 6762 §5.2 */
+var refreshPoints = []float64{ 0.80, 0.85, 0.90, 0.95 }
+
+const refreshJitter = 0.02
+
+type cacheKey struct {
+    name  string
+    rtype Type
+    class Class
+}
+
+type cacheEntry struct {
+    rr        *Record
+    received  time.Time
+    expires   time.Time
+    refreshes int
+    jitter    float64
+}
+
+type Cache struct {
+    mutex    sync.Mutex
+    entries  map[cacheKey][]*cacheEntry
+    interest map[cacheKey]bool
+}
+
+func NewCache() *Cache {
+    return &Cache{
+        entries:  make(map[cacheKey][]*cacheEntry),
+        interest: make(map[cacheKey]bool),
+    }
+}
+
+func MakeCacheKey(name []byte, t Type, class Class) cacheKey {
+    return cacheKey{
+        name:  strings.ToLower(string(name)),
+        rtype: t,
+        class: class &^ ClassCacheFlush,
+    }
+}
+
+func (c *Cache) Add(msg *Message) {
+    now := time.Now()
+
+    for _, rr := range msg.Answer {
+        c.Insert(rr, now)
+    }
+
+    for _, rr := range msg.Authority {
+        c.Insert(rr, now)
+    }
+
+    for _, rr := range msg.Additional {
+        c.Insert(rr, now)
+    }
+}
+
+/* Returns true if the record wasn't already in the cache. */
+func (c *Cache) Insert(rr *Record, now time.Time) bool {
+    if rr.Type == TypeOPT || rr.RData == nil {
+        return false
+    }
+
+    c.mutex.Lock()
+    defer c.mutex.Unlock()
+
+    key := MakeCacheKey(rr.Name, rr.Type, rr.Class)
+
+    var entries []*cacheEntry
+
+    added := true
+
+    for _, e := range c.entries[key] {
+        /* the new record replaces the cached copy of the same data */
+        if IsSameRData(e.rr, rr) {
+            added = false
+            continue
+        }
+
+        /* whatever the owner didn't send along with this record in the
+         * last second expires one second from now, RFC 6762 §10.2 */
+        if rr.Class & ClassCacheFlush != 0 &&
+           now.Sub(e.received) > cacheFlushWait {
+            flush := now.Add(cacheFlushWait)
+
+            if e.expires.After(flush) {
+                e.expires = flush
+
+                /* no point in refreshing a record that is going away */
+                e.refreshes = len(refreshPoints)
+            }
+        }
+
+        entries = append(entries, e)
+    }
+
+    ttl := time.Duration(rr.TTL) * time.Second
+
+    /* goodbye packets don't remove the record right away, RFC 6762 §10.1 */
+    if rr.TTL == 0 {
+        ttl = goodbyeTTL
+    }
+
+    entries = append(entries, &cacheEntry{
+        rr:       rr,
+        received: now,
+        expires:  now.Add(ttl),
+        jitter:   rand.Float64() * refreshJitter,
+    })
+
+    c.entries[key] = entries
+
+    return added
+}
+
+func (c *Cache) Lookup(name []byte, t Type, class Class) []*Record {
+    c.mutex.Lock()
+    defer c.mutex.Unlock()
+
+    var rrs []*Record
+
+    now := time.Now()
+
+    for _, e := range c.entries[MakeCacheKey(name, t, class)] {
+        if now.Before(e.expires) != true {
+            continue
+        }
+
+        rr := *e.rr
+
+        rr.TTL = uint32(e.expires.Sub(now) / time.Second)
+
+        rrs = append(rrs, &rr)
+    }
+
+    return rrs
+}
+
+func (c *Cache) Expire(now time.Time) []*Record {
+    c.mutex.Lock()
+    defer c.mutex.Unlock()
+
+    var expired []*Record
+
+    for key, entries := range c.entries {
+        var keep []*cacheEntry
+
+        for _, e := range entries {
+            if now.Before(e.expires) {
+                keep = append(keep, e)
+            } else {
+                expired = append(expired, e.rr)
+            }
+        }
+
+        if len(keep) == 0 {
+            delete(c.entries, key)
+        } else {
+            c.entries[key] = keep
+        }
+    }
+
+    return expired
+}
+
+func (c *Cache) Interest(q *Question) {
+    c.mutex.Lock()
+    defer c.mutex.Unlock()
+
+    c.interest[MakeCacheKey(q.Name, q.Type, q.Class)] = true
+}
+
+func (c *Cache) Forget(q *Question) {
+    c.mutex.Lock()
+    defer c.mutex.Unlock()
+
+    delete(c.interest, MakeCacheKey(q.Name, q.Type, q.Class))
+}
+
+/* Returns the questions that need to be asked again to refresh records
+ * of interest before they expire. */
+func (c *Cache) Maintain(now time.Time) []*Question {
+    c.mutex.Lock()
+    defer c.mutex.Unlock()
+
+    var qs []*Question
+
+    for key, entries := range c.entries {
+        if c.interest[key] != true {
+            continue
+        }
+
+        refresh := false
+
+        for _, e := range entries {
+            lifetime := e.expires.Sub(e.received)
+            elapsed  := now.Sub(e.received)
+
+            for e.refreshes < len(refreshPoints) {
+                point := refreshPoints[e.refreshes] + e.jitter
+
+                if float64(elapsed) < float64(lifetime) * point {
+                    break
+                }
+
+                e.refreshes++
+                refresh = true
+            }
+        }
+
+        if refresh {
+            qs = append(qs, NewQD([]byte(key.name), key.rtype, key.class))
+        }
+    }
+
+    return qs
+}
+
+/* Keeps the cache up to date with the responses received on the given
+ * connection, until done is closed. */
+func (c *Cache) Run(conn *Conn, done <-chan struct{}) {
+    packets := make(chan *packet)
+
+    go func() {
+        for {
+            pkt := ReadPacket(conn)
+
+            select {
+            case packets <- pkt:
+
+            case <-done:
+                return
+            }
+        }
+    }()
+
+    ticker := time.NewTicker(cacheTick)
+    defer ticker.Stop()
+
+    for {
+        select {
+        case pkt := <-packets:
+            if pkt.err == nil && pkt.msg.Header.Flags & FlagQR != 0 {
+                c.Add(pkt.msg)
+            }
+
+        case now := <-ticker.C:
+            c.Expire(now)
+
+            qs := c.Maintain(now)
+            if len(qs) == 0 {
+                continue
+            }
+
+            req := new(Message)
+
+            for _, q := range qs {
+                req.AppendQD(q)
+            }
+
+            Write(conn, conn.Group, req)
+
+        case <-done:
+            return
+        }
+    }
+}
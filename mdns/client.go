@@ -0,0 +1,393 @@
+/*
+ * Minimal multicast DNS server.
+ *
+ * Copyright (c) 2014, Alessandro Ghedini
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are
+ * met:
+ *
+ *     * Redistributions of source code must retain the above copyright
+ *       notice, this list of conditions and the following disclaimer.
+ *
+ *     * Redistributions in binary form must reproduce the above copyright
+ *       notice, this list of conditions and the following disclaimer in the
+ *       documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS
+ * IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO,
+ * THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR
+ * PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR
+ * CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL,
+ * EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+ * PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+ * PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF
+ * LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING
+ * NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+ * SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package mdns
+
+import "context"
+import "fmt"
+import "math"
+import "math/rand"
+import "net"
+import "time"
+
+const requestTimeout = 3 * time.Second
+
+type Mode int
+
+const (
+    /* one-shot queries from an ephemeral port, answered via unicast with
+     * the query ID echoed (RFC 6762 section 6.7) */
+    ModeLegacy Mode = iota
+
+    /* fully compliant querier sending from port 5353 and listening for the
+     * multicast answers, alongside any responder running on the host */
+    ModeMulticast
+)
+
+type Client struct {
+    Mode      Mode
+    Timeout   time.Duration
+    Retries   int
+    Interface *net.Interface
+    IPv6      bool
+    Unicast   bool
+}
+
+type Response struct {
+    From    *net.UDPAddr
+    Records []*Record
+}
+
+func SendRequest(req *Message) (*Message, error) {
+    return new(Client).Exchange(context.Background(), req)
+}
+
+func GatherRequest(req *Message) (*Message, []*Response, error) {
+    return new(Client).Gather(context.Background(), req)
+}
+
+func (m Mode) String() string {
+    switch m {
+    case ModeLegacy:
+        return "legacy"
+
+    case ModeMulticast:
+        return "multicast"
+
+    default:
+        return "unknown"
+    }
+}
+
+func ParseMode(str string) (Mode, error) {
+    switch str {
+    case "legacy":
+        return ModeLegacy, nil
+
+    case "multicast":
+        return ModeMulticast, nil
+
+    default:
+        return 0, fmt.Errorf("Invalid query mode '%s'", str)
+    }
+}
+
+func (c *Client) Dial() (*Conn, error) {
+    host := "0.0.0.0"
+    port := "0"
+
+    if c.IPv6 {
+        host = "::"
+    }
+
+    if c.Mode == ModeMulticast {
+        port = "5353"
+    }
+
+    conn, err := NewClient(net.JoinHostPort(host, port))
+    if err != nil {
+        return nil, fmt.Errorf("Could not create client: %s", err)
+    }
+
+    if c.Mode != ModeMulticast {
+        return conn, nil
+    }
+
+    err = conn.SetHopLimit(255)
+    if err != nil {
+        conn.Close()
+        return nil, fmt.Errorf("Could not set hop limit: %s", err)
+    }
+
+    ifis := []net.Interface{}
+
+    if c.Interface != nil {
+        ifis = append(ifis, *c.Interface)
+    } else {
+        ifis, err = MulticastInterfaces()
+        if err != nil {
+            conn.Close()
+            return nil, err
+        }
+    }
+
+    joined := false
+
+    for i := range ifis {
+        if conn.JoinGroup(&ifis[i]) == nil {
+            joined = true
+        }
+    }
+
+    if joined != true {
+        conn.Close()
+        return nil, fmt.Errorf("Could not join multicast group")
+    }
+
+    return conn, nil
+}
+
+/* Returns the first response that answers the request. */
+func (c *Client) Exchange(ctx context.Context, req *Message) (*Message, error) {
+    var last error
+
+    conn, err := c.Dial()
+    if err != nil {
+        return nil, err
+    }
+    defer conn.Close()
+
+    stop := WatchContext(ctx, conn)
+    defer close(stop)
+
+    req = c.Prepare(req)
+
+    for i := 0; i <= c.Retries; i++ {
+        deadline, err := c.Send(ctx, conn, req)
+        if err != nil {
+            return nil, err
+        }
+
+        for {
+            rsp, _, _, _, _, err := Read(conn)
+
+            if ctx.Err() != nil {
+                return nil, ctx.Err()
+            }
+
+            if err != nil {
+                /* skip garbage until we run out of time */
+                if time.Now().Before(deadline) {
+                    continue
+                }
+
+                last = err
+                break
+            }
+
+            if c.IsAnswerTo(req, rsp) {
+                return rsp, nil
+            }
+        }
+    }
+
+    return nil, fmt.Errorf("Could not read response: %s", last)
+}
+
+/* Like Exchange, but waits for the whole timeout and merges the answers of
+ * every responder, the returned responses tell who answered what. */
+func (c *Client) Gather(ctx context.Context, req *Message) (*Message, []*Response, error) {
+    var responses []*Response
+
+    conn, err := c.Dial()
+    if err != nil {
+        return nil, nil, err
+    }
+    defer conn.Close()
+
+    stop := WatchContext(ctx, conn)
+    defer close(stop)
+
+    req = c.Prepare(req)
+
+    rsp := new(Message)
+
+    rsp.Header.Id     = req.Header.Id
+    rsp.Header.Flags |= FlagQR
+
+    for _, q := range req.Question {
+        rsp.AppendQD(q)
+    }
+
+    responders := make(map[string]*Response)
+
+    for i := 0; i <= c.Retries && len(responses) == 0; i++ {
+        deadline, err := c.Send(ctx, conn, req)
+        if err != nil {
+            return nil, nil, err
+        }
+
+        for time.Now().Before(deadline) {
+            pkt := ReadPacket(conn)
+
+            if ctx.Err() != nil {
+                return nil, nil, ctx.Err()
+            }
+
+            if pkt.err != nil || c.IsAnswerTo(req, pkt.msg) != true {
+                continue
+            }
+
+            r, ok := responders[pkt.from.String()]
+            if ok != true {
+                r = &Response{ From: pkt.from }
+
+                responders[pkt.from.String()] = r
+                responses = append(responses, r)
+            }
+
+            for _, rr := range pkt.msg.Answer {
+                if HasRecord(r.Records, rr) != true {
+                    r.Records = append(r.Records, rr)
+                }
+
+                if HasRecord(rsp.Answer, rr) != true {
+                    rsp.AppendAN(rr)
+                }
+            }
+
+            for _, rr := range pkt.msg.Additional {
+                if rr.Type == TypeOPT {
+                    continue
+                }
+
+                if HasRecord(rsp.Additional, rr) != true {
+                    rsp.AppendAR(rr)
+                }
+            }
+        }
+    }
+
+    if len(responses) == 0 {
+        return nil, nil, fmt.Errorf("No response")
+    }
+
+    return rsp, responses, nil
+}
+
+/* Returns a copy of the request with the options of the client applied. */
+func (c *Client) Prepare(req *Message) *Message {
+    msg := *req
+
+    /* legacy answers are matched by the echoed ID, multicast queries must
+     * use 0 instead */
+    if c.Mode == ModeLegacy {
+        if msg.Header.Id == 0 {
+            msg.Header.Id = uint16(rand.Intn(math.MaxUint16)) + 1
+        }
+    } else {
+        msg.Header.Id = 0
+    }
+
+    msg.Question = nil
+    msg.Header.QDCount = 0
+
+    for _, q := range req.Question {
+        qd := *q
+
+        if c.Unicast {
+            qd.Class |= ClassUnicast
+        }
+
+        msg.AppendQD(&qd)
+    }
+
+    /* let responders know larger unicast responses are fine */
+    if c.Mode == ModeLegacy && FindEDNS(req) == nil {
+        msg.Additional = append([]*Record{}, req.Additional...)
+
+        msg.AppendAR(NewEDNS(ednsSize, 0, false))
+    }
+
+    return &msg
+}
+
+/* Sends the request and returns the time until which the answers are to
+ * be waited for. */
+func (c *Client) Send(ctx context.Context, conn *Conn, req *Message) (time.Time, error) {
+    timeout := c.Timeout
+    if timeout == 0 {
+        timeout = requestTimeout
+    }
+
+    deadline := time.Now().Add(timeout)
+
+    if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+        deadline = d
+    }
+
+    err := WriteInterface(conn, c.Interface, conn.Group, req)
+    if err != nil {
+        return deadline, fmt.Errorf("Could not send request: %s", err)
+    }
+
+    conn.SetReadDeadline(deadline)
+
+    if ctx.Err() != nil {
+        return deadline, ctx.Err()
+    }
+
+    return deadline, nil
+}
+
+/* Unblocks any pending read on the connection once the context is done. */
+func WatchContext(ctx context.Context, conn *Conn) chan struct{} {
+    stop := make(chan struct{})
+
+    go func() {
+        select {
+        case <-ctx.Done():
+            conn.SetReadDeadline(time.Now())
+
+        case <-stop:
+        }
+    }()
+
+    return stop
+}
+
+func (c *Client) IsAnswerTo(req, rsp *Message) bool {
+    if c.Mode == ModeLegacy && rsp.Header.Id != req.Header.Id {
+        return false
+    }
+
+    return IsAnswerTo(req, rsp)
+}
+
+func IsAnswerTo(req, rsp *Message) bool {
+    if rsp.Header.Flags & FlagQR == 0 {
+        return false
+    }
+
+    for _, q := range req.Question {
+        for _, rr := range rsp.Answer {
+            if q.Matches(rr) {
+                return true
+            }
+
+            /* negative answer */
+            if rr.Type == TypeNSEC && IsSameName(rr.Name, string(q.Name)) {
+                return true
+            }
+        }
+    }
+
+    return false
+}
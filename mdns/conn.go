@@ -0,0 +1,285 @@
+/*
+ * Minimal multicast DNS server.
+ *
+ * Copyright (c) 2014, Alessandro Ghedini
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are
+ * met:
+ *
+ *     * Redistributions of source code must retain the above copyright
+ *       notice, this list of conditions and the following disclaimer.
+ *
+ *     * Redistributions in binary form must reproduce the above copyright
+ *       notice, this list of conditions and the following disclaimer in the
+ *       documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS
+ * IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO,
+ * THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR
+ * PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR
+ * CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL,
+ * EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+ * PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+ * PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF
+ * LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING
+ * NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+ * SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package mdns
+
+import "context"
+import "fmt"
+import "net"
+import "syscall"
+import "time"
+
+import "golang.org/x/net/ipv4"
+import "golang.org/x/net/ipv6"
+
+const maddr4 = "224.0.0.251:5353"
+const maddr6 = "[FF02::FB]:5353"
+
+type Conn struct {
+    Group *net.UDPAddr
+
+    p4 *ipv4.PacketConn
+    p6 *ipv6.PacketConn
+}
+
+func NewConn(addr string) (*Conn, error) {
+    saddr, err := net.ResolveUDPAddr("udp", addr)
+    if err != nil {
+        return nil,
+          fmt.Errorf("Could not resolve address '%s': %s", addr, err)
+    }
+
+    if saddr.IP != nil && saddr.IP.To4() == nil {
+        return NewConn6(saddr)
+    }
+
+    return NewConn4(saddr)
+}
+
+func NewConn4(saddr *net.UDPAddr) (*Conn, error) {
+    smaddr, err := net.ResolveUDPAddr("udp4", maddr4)
+    if err != nil {
+        return nil,
+          fmt.Errorf("Could not resolve address '%s': %s", maddr4, err)
+    }
+
+    udp, err := ListenUDP("udp4", saddr, saddr.Port == smaddr.Port)
+    if err != nil {
+        return nil, fmt.Errorf("Could not listen: %s", err)
+    }
+
+    p := ipv4.NewPacketConn(udp)
+
+    err = p.SetTTL(1)
+    if err != nil {
+        return nil, fmt.Errorf("Could not set TTL: %s", err)
+    }
+
+    err = p.SetControlMessage(ipv4.FlagInterface|ipv4.FlagDst, true)
+    if err != nil {
+        return nil, fmt.Errorf("Could not set ctrlmsg: %s", err)
+    }
+
+    return &Conn{ Group: smaddr, p4: p }, nil
+}
+
+func NewConn6(saddr *net.UDPAddr) (*Conn, error) {
+    smaddr, err := net.ResolveUDPAddr("udp6", maddr6)
+    if err != nil {
+        return nil,
+          fmt.Errorf("Could not resolve address '%s': %s", maddr6, err)
+    }
+
+    udp, err := ListenUDP("udp6", saddr, saddr.Port == smaddr.Port)
+    if err != nil {
+        return nil, fmt.Errorf("Could not listen: %s", err)
+    }
+
+    p := ipv6.NewPacketConn(udp)
+
+    err = p.SetHopLimit(1)
+    if err != nil {
+        return nil, fmt.Errorf("Could not set hop limit: %s", err)
+    }
+
+    err = p.SetControlMessage(ipv6.FlagInterface|ipv6.FlagDst, true)
+    if err != nil {
+        return nil, fmt.Errorf("Could not set ctrlmsg: %s", err)
+    }
+
+    return &Conn{ Group: smaddr, p6: p }, nil
+}
+
+/* The mDNS port is shared with the other responders and queriers running on
+ * the same host, so it has to be bound with SO_REUSEADDR/SO_REUSEPORT. */
+func ListenUDP(network string, saddr *net.UDPAddr, reuse bool) (*net.UDPConn, error) {
+    if reuse != true {
+        return net.ListenUDP(network, saddr)
+    }
+
+    lc := net.ListenConfig{ Control: ReuseControl }
+
+    pc, err := lc.ListenPacket(context.Background(), network, saddr.String())
+    if err != nil {
+        return nil, err
+    }
+
+    return pc.(*net.UDPConn), nil
+}
+
+func ReuseControl(network, address string, c syscall.RawConn) error {
+    var serr error
+
+    err := c.Control(func(fd uintptr) {
+        serr = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET,
+                                     syscall.SO_REUSEADDR, 1)
+        if serr != nil {
+            return
+        }
+
+        serr = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET,
+                                     soReusePort, 1)
+    })
+    if err != nil {
+        return err
+    }
+
+    return serr
+}
+
+func (c *Conn) SetHopLimit(hops int) error {
+    if c.IsIPv6() {
+        err := c.p6.SetHopLimit(hops)
+        if err != nil {
+            return err
+        }
+
+        return c.p6.SetMulticastHopLimit(hops)
+    }
+
+    err := c.p4.SetTTL(hops)
+    if err != nil {
+        return err
+    }
+
+    return c.p4.SetMulticastTTL(hops)
+}
+
+func (c *Conn) SetMulticastLoopback(on bool) error {
+    if c.IsIPv6() {
+        return c.p6.SetMulticastLoopback(on)
+    }
+
+    return c.p4.SetMulticastLoopback(on)
+}
+
+func (c *Conn) IsIPv6() bool {
+    return c.p6 != nil
+}
+
+func (c *Conn) HasFamily(local4, local6 *net.IPNet) bool {
+    if c.IsIPv6() {
+        return local6 != nil
+    }
+
+    return local4 != nil
+}
+
+func (c *Conn) LocalAddr() *net.UDPAddr {
+    if c.IsIPv6() {
+        return c.p6.LocalAddr().(*net.UDPAddr)
+    }
+
+    return c.p4.LocalAddr().(*net.UDPAddr)
+}
+
+/* Returns the index of the interface the packet was received on, or 0 if
+ * the kernel didn't tell. */
+func (c *Conn) ReadFrom(b []byte) (int, int, *net.UDPAddr, error) {
+    if c.IsIPv6() {
+        n, cm, from, err := c.p6.ReadFrom(b)
+        if err != nil {
+            return 0, 0, nil, err
+        }
+
+        if cm == nil {
+            return n, 0, from.(*net.UDPAddr), nil
+        }
+
+        return n, cm.IfIndex, from.(*net.UDPAddr), nil
+    }
+
+    n, cm, from, err := c.p4.ReadFrom(b)
+    if err != nil {
+        return 0, 0, nil, err
+    }
+
+    if cm == nil {
+        return n, 0, from.(*net.UDPAddr), nil
+    }
+
+    return n, cm.IfIndex, from.(*net.UDPAddr), nil
+}
+
+func (c *Conn) WriteTo(b []byte, ifi *net.Interface, addr *net.UDPAddr) error {
+    var err error
+
+    if c.IsIPv6() {
+        var cm *ipv6.ControlMessage
+
+        if ifi != nil {
+            cm = &ipv6.ControlMessage{ IfIndex: ifi.Index }
+        }
+
+        _, err = c.p6.WriteTo(b, cm, addr)
+    } else {
+        var cm *ipv4.ControlMessage
+
+        if ifi != nil {
+            cm = &ipv4.ControlMessage{ IfIndex: ifi.Index }
+        }
+
+        _, err = c.p4.WriteTo(b, cm, addr)
+    }
+
+    return err
+}
+
+func (c *Conn) JoinGroup(ifi *net.Interface) error {
+    if c.IsIPv6() {
+        return c.p6.JoinGroup(ifi, c.Group)
+    }
+
+    return c.p4.JoinGroup(ifi, c.Group)
+}
+
+func (c *Conn) LeaveGroup(ifi *net.Interface) error {
+    if c.IsIPv6() {
+        return c.p6.LeaveGroup(ifi, c.Group)
+    }
+
+    return c.p4.LeaveGroup(ifi, c.Group)
+}
+
+func (c *Conn) SetReadDeadline(t time.Time) error {
+    if c.IsIPv6() {
+        return c.p6.SetReadDeadline(t)
+    }
+
+    return c.p4.SetReadDeadline(t)
+}
+
+func (c *Conn) Close() error {
+    if c.IsIPv6() {
+        return c.p6.Close()
+    }
+
+    return c.p4.Close()
+}
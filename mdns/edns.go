@@ -0,0 +1,109 @@
+/*
+ * Minimal multicast DNS server.
+ *
+ * Copyright (c) 2014, Alessandro Ghedini
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are
+ * met:
+ *
+ *     * Redistributions of source code must retain the above copyright
+ *       notice, this list of conditions and the following disclaimer.
+ *
+ *     * Redistributions in binary form must reproduce the above copyright
+ *       notice, this list of conditions and the following disclaimer in the
+ *       documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS
+ * IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO,
+ * THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR
+ * PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR
+ * CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL,
+ * EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+ * PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+ * PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF
+ * LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING
+ * NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+ * SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package mdns
+
+/* the UDP payload size we advertise, RFC 6891 §6.2.5 */
+const ednsSize = 4096
+
+const ednsVersion = 0
+
+const ednsFlagDO = 1 << 15
+
+/* the upper 8 bits of the 12 bit extended rcode */
+const ExtRCodeBadVers = 1
+
+/* EDNS0 parameters live in the class and TTL of the OPT record, RFC 6891
+ * §6.1.3. */
+func NewEDNS(size uint16, rcode uint8, do bool) *Record {
+    rr := NewAN([]byte("."), Class(size), uint32(rcode) << 24, new(OPT))
+
+    if do {
+        rr.TTL |= ednsFlagDO
+    }
+
+    return rr
+}
+
+func FindEDNS(msg *Message) *Record {
+    for _, rr := range msg.Additional {
+        if rr.Type == TypeOPT {
+            return rr
+        }
+    }
+
+    return nil
+}
+
+func EDNSPayloadSize(rr *Record) uint16 {
+    /* anything less is to be treated as 512, RFC 6891 §6.2.5 */
+    if rr.Class < legacySize {
+        return legacySize
+    }
+
+    return uint16(rr.Class)
+}
+
+func EDNSExtendedRCode(rr *Record) uint8 {
+    return uint8(rr.TTL >> 24)
+}
+
+func EDNSVersion(rr *Record) uint8 {
+    return uint8(rr.TTL >> 16)
+}
+
+func EDNSDo(rr *Record) bool {
+    return rr.TTL & ednsFlagDO != 0
+}
+
+func EDNSOptions(rr *Record) []Option {
+    opt, ok := rr.RData.(*OPT)
+    if ok != true {
+        return nil
+    }
+
+    return opt.Options
+}
+
+/* Returns the largest legacy unicast response the querier accepts. */
+func LegacySize(req *Message) int {
+    opt := FindEDNS(req)
+    if opt == nil {
+        return legacySize
+    }
+
+    size := int(EDNSPayloadSize(opt))
+
+    if size > maxPacketSize {
+        return maxPacketSize
+    }
+
+    return size
+}
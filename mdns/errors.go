@@ -0,0 +1,119 @@
+/*
+ * Minimal multicast DNS server.
+ *
+ * Copyright (c) 2014, Alessandro Ghedini
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are
+ * met:
+ *
+ *     * Redistributions of source code must retain the above copyright
+ *       notice, this list of conditions and the following disclaimer.
+ *
+ *     * Redistributions in binary form must reproduce the above copyright
+ *       notice, this list of conditions and the following disclaimer in the
+ *       documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS
+ * IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO,
+ * THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR
+ * PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR
+ * CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL,
+ * EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+ * PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+ * PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF
+ * LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING
+ * NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+ * SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package mdns
+
+import "errors"
+import "fmt"
+
+/* names are limited to 255 octets on the wire, labels to 63, RFC 1035 */
+const maxNameLen  = 255
+const maxLabelLen = 63
+
+var ErrPointerLoop    = errors.New("compression pointer loop")
+var ErrForwardPointer = errors.New("compression pointer points forward")
+var ErrLabelTooLong   = errors.New("label longer than 63 octets")
+var ErrNameTooLong    = errors.New("name longer than 255 octets")
+var ErrBadEscape      = errors.New("bad escape sequence in name")
+
+/* Returned when a name can't be decoded, with the offset it starts at. */
+type NameError struct {
+    Off int
+    Err error
+}
+
+func (e *NameError) Error() string {
+    return fmt.Sprintf("bad name at offset %d: %s", e.Off, e.Err)
+}
+
+func (e *NameError) Unwrap() error {
+    return e.Err
+}
+
+var ErrTruncated    = errors.New("message truncated")
+var ErrBadName      = errors.New("bad name")
+var ErrBadRData     = errors.New("bad rdata")
+var ErrUnknownType  = errors.New("unknown type")
+var ErrTrailingData = errors.New("trailing data")
+
+func (e *NameError) Is(target error) bool {
+    return target == ErrBadName
+}
+
+type Section int
+
+const (
+    SectionHeader Section = iota
+    SectionQuestion
+    SectionAnswer
+    SectionAuthority
+    SectionAdditional
+)
+
+func (s Section) String() string {
+    switch s {
+    case SectionHeader:
+        return "header"
+
+    case SectionQuestion:
+        return "question"
+
+    case SectionAnswer:
+        return "answer"
+
+    case SectionAuthority:
+        return "authority"
+
+    case SectionAdditional:
+        return "additional"
+
+    default:
+        return "unknown"
+    }
+}
+
+/* Tells which entry of which section of the message couldn't be decoded. */
+type DecodeError struct {
+    Section Section
+    Index   int
+    Err     error
+}
+
+func (e *DecodeError) Error() string {
+    if e.Section == SectionHeader {
+        return fmt.Sprintf("Could not unpack header: %s", e.Err)
+    }
+
+    return fmt.Sprintf("Could not unpack %s %d: %s", e.Section, e.Index, e.Err)
+}
+
+func (e *DecodeError) Unwrap() error {
+    return e.Err
+}
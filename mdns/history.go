@@ -0,0 +1,110 @@
+/*
+ * Minimal multicast DNS server.
+ *
+ * Copyright (c) 2014, Alessandro Ghedini
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are
+ * met:
+ *
+ *     * Redistributions of source code must retain the above copyright
+ *       notice, this list of conditions and the following disclaimer.
+ *
+ *     * Redistributions in binary form must reproduce the above copyright
+ *       notice, this list of conditions and the following disclaimer in the
+ *       documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS
+ * IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO,
+ * THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR
+ * PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR
+ * CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL,
+ * EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+ * PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+ * PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF
+ * LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING
+ * NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+ * SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package mdns
+
+import "net"
+import "sync"
+import "time"
+
+type historyKey struct {
+    conn    *Conn
+    ifindex int
+    cache   cacheKey
+    rdata   string
+}
+
+type historyEntry struct {
+    sent time.Time
+    ttl  uint32
+}
+
+/* Keeps track of when each record was last multicast on each interface, for
+ * each address family separately. */
+type History struct {
+    mutex   sync.Mutex
+    entries map[historyKey]historyEntry
+}
+
+func NewHistory() *History {
+    return &History{ entries: make(map[historyKey]historyEntry) }
+}
+
+func MakeHistoryKey(c *Conn, ifi *net.Interface, rr *Record) historyKey {
+    key := historyKey{
+        conn:  c,
+        cache: MakeCacheKey(rr.Name, rr.Type, rr.Class),
+        rdata: string(RawRData(rr)),
+    }
+
+    if ifi != nil {
+        key.ifindex = ifi.Index
+    }
+
+    return key
+}
+
+func (h *History) Add(c *Conn, ifi *net.Interface, rrs []*Record, now time.Time) {
+    h.mutex.Lock()
+    defer h.mutex.Unlock()
+
+    for key, e := range h.entries {
+        if now.Sub(e.sent) > time.Duration(e.ttl) * time.Second {
+            delete(h.entries, key)
+        }
+    }
+
+    for _, rr := range rrs {
+        h.entries[MakeHistoryKey(c, ifi, rr)] = historyEntry{
+            sent: now,
+            ttl:  rr.TTL,
+        }
+    }
+}
+
+/* Returns the time the record was last multicast on the connection and
+ * interface, or the zero time if it wasn't. */
+func (h *History) LastSent(c *Conn, ifi *net.Interface, rr *Record) time.Time {
+    h.mutex.Lock()
+    defer h.mutex.Unlock()
+
+    return h.entries[MakeHistoryKey(c, ifi, rr)].sent
+}
+
+/* Returns true if the record was multicast on the interface within a quarter
+ * of its TTL, RFC 6762 §5.4. */
+func (h *History) IsRecent(c *Conn, ifi *net.Interface, rr *Record, now time.Time) bool {
+    sent := h.LastSent(c, ifi, rr)
+    if sent.IsZero() {
+        return false
+    }
+
+    return now.Sub(sent) < time.Duration(rr.TTL) * time.Second / 4
+}
@@ -0,0 +1,147 @@
+/*
+ * Minimal multicast DNS server.
+ *
+ * Copyright (c) 2014, Alessandro Ghedini
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are
+ * met:
+ *
+ *     * Redistributions of source code must retain the above copyright
+ *       notice, this list of conditions and the following disclaimer.
+ *
+ *     * Redistributions in binary form must reproduce the above copyright
+ *       notice, this list of conditions and the following disclaimer in the
+ *       documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS
+ * IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO,
+ * THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR
+ * PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR
+ * CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL,
+ * EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+ * PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+ * PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF
+ * LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING
+ * NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+ * SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package mdns
+
+import "fmt"
+
+/* Names are kept in presentation format, where a '.' or '\' that is part of
+ * a label is escaped with a '\', and any other octet can be written as \DDD,
+ * RFC 4343 §2.1. This lets DNS-SD instance names contain dots. */
+
+/* Splits a name into its unescaped labels. */
+func SplitName(name []byte) ([][]byte, error) {
+    var labels [][]byte
+    var label  []byte
+
+    if len(name) == 0 || string(name) == "." {
+        return nil, nil
+    }
+
+    end := false
+
+    for i := 0; i < len(name); i++ {
+        c := name[i]
+
+        end = false
+
+        switch {
+        case c == '.':
+            labels = append(labels, label)
+            label  = nil
+            end    = true
+
+        case c != '\\':
+            label = append(label, c)
+
+        case i + 1 >= len(name):
+            return nil, ErrBadEscape
+
+        case IsDigit(name[i + 1]):
+            if i + 3 >= len(name) ||
+               IsDigit(name[i + 2]) != true || IsDigit(name[i + 3]) != true {
+                return nil, ErrBadEscape
+            }
+
+            v := int(name[i + 1] - '0') * 100 +
+                 int(name[i + 2] - '0') * 10 +
+                 int(name[i + 3] - '0')
+
+            if v > 255 {
+                return nil, ErrBadEscape
+            }
+
+            label = append(label, uint8(v))
+            i += 3
+
+        default:
+            label = append(label, name[i + 1])
+            i += 1
+        }
+    }
+
+    if end != true {
+        labels = append(labels, label)
+    }
+
+    return labels, nil
+}
+
+/* Joins the given labels into a fully qualified name, escaping them. */
+func JoinName(labels [][]byte) []byte {
+    var name []byte
+
+    if len(labels) == 0 {
+        return []byte(".")
+    }
+
+    for _, label := range labels {
+        name = append(name, EscapeLabel(label)...)
+        name = append(name, '.')
+    }
+
+    return name
+}
+
+/* Returns the name spelled the way UnpackName spells it, so that names can be
+ * compared as strings. Names that can't be parsed are returned as they are. */
+func CanonicalName(name []byte) []byte {
+    labels, err := SplitName(name)
+    if err != nil || len(labels) == 0 {
+        return name
+    }
+
+    return JoinName(labels)
+}
+
+/* Escapes dots, backslashes and control characters in a single label. Other
+ * octets are left alone, so that UTF-8 names stay readable, RFC 6762 §16. */
+func EscapeLabel(label []byte) []byte {
+    var b []byte
+
+    for _, c := range label {
+        switch {
+        case c == '.' || c == '\\':
+            b = append(b, '\\', c)
+
+        case c < 0x20 || c == 0x7F:
+            b = append(b, fmt.Sprintf("\\%03d", c)...)
+
+        default:
+            b = append(b, c)
+        }
+    }
+
+    return b
+}
+
+func IsDigit(c byte) bool {
+    return c >= '0' && c <= '9'
+}
@@ -36,136 +36,277 @@ import "log"
 import "math"
 import "math/rand"
 import "net"
+import "sync"
 import "time"
 import "syscall"
 import "unsafe"
 
-import "golang.org/x/net/ipv4"
-
 import "github.com/ghedo/moodns/netlink"
 
-const maddr4 = "224.0.0.251:5353"
-const maddr6 = "[FF02::FB]:5353"
+type Server struct {
+    Name     string
+    Services *Registry
+    Silent   bool
+    Forward  bool
+
+    OnConflict func(old, new string)
+
+    conns     []*Conn
+    packets   chan *packet
+    listeners map[chan *packet]bool
+    probing   bool
+    instances map[string]bool
+    mutex     sync.Mutex
+    done      chan struct{}
+    pending   map[string]*query
+    outgoing  map[outgoingKey]*outgoing
+    history   *History
+    sent_id   uint16
+    orig_name string
+    conflicts int
+}
+
+type packet struct {
+    conn     *Conn
+    ifi      *net.Interface
+    msg      *Message
+    local4   *net.IPNet
+    local6   *net.IPNet
+    from     *net.UDPAddr
+    loopback bool
+    err      error
+}
 
-func NewConn(addr string) (*net.UDPAddr, *ipv4.PacketConn, error) {
-    saddr, err := net.ResolveUDPAddr("udp", addr)
+func NewServer(addr string) (*Server, error) {
+    host, port, err := net.SplitHostPort(addr)
     if err != nil {
-        return nil, nil,
-          fmt.Errorf("Could not resolve address '%s': %s", addr, err)
+        return nil,
+          fmt.Errorf("Could not parse address '%s': %s", addr, err)
     }
 
-    smaddr, err := net.ResolveUDPAddr("udp", maddr4)
-    if err != nil {
-        return nil, nil,
-          fmt.Errorf("Could not resolve address '%s': %s", maddr4, err)
+    s := &Server{
+        packets: make(chan *packet),
+        done:    make(chan struct{}),
+        history: NewHistory(),
     }
 
-    udp, err := net.ListenUDP("udp", saddr)
-    if err != nil {
-        return nil, nil,
-          fmt.Errorf("Could not listen: %s", err)
+    /* no host means both IPv4 and IPv6, but don't fail if the system
+     * doesn't support the latter */
+    if host == "" {
+        c, err := NewConn(net.JoinHostPort("0.0.0.0", port))
+        if err != nil {
+            return nil, err
+        }
+
+        s.conns = append(s.conns, c)
+
+        c, err = NewConn(net.JoinHostPort("::", port))
+        if err == nil {
+            s.conns = append(s.conns, c)
+        }
+    } else {
+        c, err := NewConn(addr)
+        if err != nil {
+            return nil, err
+        }
+
+        s.conns = append(s.conns, c)
     }
 
-    p := ipv4.NewPacketConn(udp)
+    for _, c := range s.conns {
+        /* responses are sent with the maximum hop limit, RFC 6762 §11 */
+        err := c.SetHopLimit(255)
+        if err != nil {
+            return nil, fmt.Errorf("Could not set hop limit: %s", err)
+        }
 
-    err = p.SetTTL(1)
-    if err != nil {
-        return nil, nil,
-          fmt.Errorf("Could not set TTL: %s", err)
+        /* queriers sharing the port on this host need to see our answers
+         * too (RFC 6762 section 15), our own packets are harmless */
+        err = c.SetMulticastLoopback(true)
+        if err != nil {
+            return nil, fmt.Errorf("Could not set loop: %s", err)
+        }
+
+        go MonitorNetwork(c)
     }
 
-    err = p.SetMulticastLoopback(false)
-    if err != nil {
-        return nil, nil, fmt.Errorf("Could not set loop: %s", err)
+    return s, nil
+}
+
+func (s *Server) Close() error {
+    if s.IsClosed() {
+        return nil
     }
 
-    err = p.SetControlMessage(ipv4.FlagInterface|ipv4.FlagDst, true)
-    if err != nil {
-        return nil, nil, fmt.Errorf("Could not set ctrlmsg: %s", err)
+    close(s.done)
+
+    if s.IsMulticast() {
+        err := s.Goodbye()
+
+        if err != nil && s.Silent != true {
+            log.Println("Error sending goodbye: ", err)
+        }
+    }
+
+    for _, c := range s.conns {
+        c.Close()
     }
 
-    return smaddr, p, nil
+    return nil
 }
 
-func NewServer(addr string) (*net.UDPAddr, *ipv4.PacketConn, error) {
-    smaddr, p, err := NewConn(addr)
-    if err != nil {
-        return nil, nil, err
+func (s *Server) IsClosed() bool {
+    select {
+    case <-s.done:
+        return true
+
+    default:
+        return false
     }
+}
 
-    go MonitorNetwork(p, smaddr)
+func (s *Server) IsMulticast() bool {
+    for _, c := range s.conns {
+        if c.LocalAddr().Port == c.Group.Port {
+            return true
+        }
+    }
 
-    return smaddr, p, nil
+    return false
 }
 
-func NewClient(addr string) (*net.UDPAddr, *ipv4.PacketConn, error) {
+func (s *Server) Receive(c *Conn) {
+    for {
+        pkt := ReadPacket(c)
+
+        select {
+        case s.packets <- pkt:
+
+        case <-s.done:
+            return
+        }
+    }
+}
+
+func NewClient(addr string) (*Conn, error) {
     return NewConn(addr)
 }
 
-func Read(p *ipv4.PacketConn) (*Message, *net.IPNet, *net.IPNet, *net.UDPAddr, bool, error) {
-    var local4 *net.IPNet
-    var local6 *net.IPNet
+func Read(c *Conn) (*Message, *net.IPNet, *net.IPNet, *net.UDPAddr, bool, error) {
+    pkt := ReadPacket(c)
 
-    var ifi *net.Interface
+    return pkt.msg, pkt.local4, pkt.local6, pkt.from, pkt.loopback, pkt.err
+}
 
-    var loopback bool
+func ReadPacket(c *Conn) *packet {
+    var err error
 
-    pkt := make([]byte, 9000)
+    pkt := &packet{ conn: c }
 
-    n, cm, from, err := p.ReadFrom(pkt)
+    buf := make([]byte, maxPacketSize)
+
+    n, ifindex, from, err := c.ReadFrom(buf)
     if err != nil {
-        return nil, nil, nil, nil, false,
-          fmt.Errorf("Could not read: %s", err)
+        pkt.err = fmt.Errorf("Could not read: %s", err)
+        return pkt
     }
 
-    if cm == nil {
-        ifi, err = net.InterfaceByName("lo")
-        if err != nil {
-            return nil, nil, nil, nil, true,
-              fmt.Errorf("Could not find if: %s", err)
-        }
+    pkt.from = from
 
-        loopback = true
+    if ifindex == 0 {
+        pkt.ifi, err = net.InterfaceByName("lo")
+        pkt.loopback = true
     } else {
-        ifi, err = net.InterfaceByIndex(cm.IfIndex)
-        if err != nil {
-            return nil, nil, nil, nil, false,
-              fmt.Errorf("Could not find if: %s", err)
-        }
+        pkt.ifi, err = net.InterfaceByIndex(ifindex)
+    }
+
+    if err != nil {
+        pkt.err = fmt.Errorf("Could not find if: %s", err)
+        return pkt
+    }
+
+    pkt.local4, pkt.local6, err = InterfaceAddrs(pkt.ifi)
+    if err != nil {
+        pkt.err = err
+        return pkt
+    }
 
-        loopback = false
+    /* a query is still worth answering if only its additional records
+     * are broken */
+    pkt.msg, err = UnpackWith(buf[:n], UnpackOptions{ Partial: true })
+    if err != nil && IsPartialError(err) != true {
+        pkt.msg = nil
+        pkt.err = fmt.Errorf("Could not unpack request: %s", err)
+        return pkt
     }
 
+    return pkt
+}
+
+func InterfaceAddrs(ifi *net.Interface) (*net.IPNet, *net.IPNet, error) {
+    var local4 *net.IPNet
+    var local6 *net.IPNet
+
     addrs, err := ifi.Addrs()
     if err != nil {
-        return nil, nil, nil, nil, loopback,
-          fmt.Errorf("Could not find addrs: %s", err)
+        return nil, nil, fmt.Errorf("Could not find addrs: %s", err)
     }
 
     for _, a := range addrs {
-        if a.(*net.IPNet).IP.To4() != nil {
-            local4 = a.(*net.IPNet)
-        } else {
-            local6 = a.(*net.IPNet)
+        ip := a.(*net.IPNet)
+
+        if ip.IP.To4() != nil {
+            local4 = ip
+            continue
+        }
+
+        /* the link-local address is the one that is guaranteed to be
+         * reachable by anyone on the link we are answering on */
+        if local6 == nil || ip.IP.IsLinkLocalUnicast() {
+            local6 = ip
         }
     }
 
-    req, err := Unpack(pkt[:n])
+    return local4, local6, nil
+}
+
+func MulticastInterfaces() ([]net.Interface, error) {
+    var ifis []net.Interface
+
+    all, err := net.Interfaces()
     if err != nil {
-        return nil, nil, nil, nil, loopback,
-          fmt.Errorf("Could not unpack request: %s", err)
+        return nil, fmt.Errorf("Could not list interfaces: %s", err)
+    }
+
+    for _, ifi := range all {
+        if ifi.Flags & net.FlagUp == 0 ||
+           ifi.Flags & net.FlagMulticast == 0 ||
+           ifi.Flags & net.FlagLoopback != 0 {
+            continue
+        }
+
+        ifis = append(ifis, ifi)
     }
 
-    return req, local4, local6, from.(*net.UDPAddr), loopback, err
+    return ifis, nil
 }
 
-func Write(p *ipv4.PacketConn, addr *net.UDPAddr, msg *Message) error {
-    pkt, err := Pack(msg)
+func Write(c *Conn, addr *net.UDPAddr, msg *Message) error {
+    return WriteInterface(c, nil, addr, msg)
+}
+
+func WriteInterface(c *Conn, ifi *net.Interface, addr *net.UDPAddr, msg *Message) error {
+    buf := GetBuffer()
+    defer PutBuffer(buf)
+
+    pkt, err := PackBuffer(*buf, msg)
     if err != nil {
         return fmt.Errorf("Could not pack response: %s", err)
     }
 
-    _, err = p.WriteTo(pkt, nil, addr)
+    *buf = pkt
+
+    err = c.WriteTo(pkt, ifi, addr)
     if err != nil {
         return fmt.Errorf("Could not write to network: %s", err)
     }
@@ -173,33 +314,35 @@ func Write(p *ipv4.PacketConn, addr *net.UDPAddr, msg *Message) error {
     return nil
 }
 
-func SendRequest(req *Message) (*Message, error) {
-    maddr, client, err := NewClient("0.0.0.0:0")
-    if err != nil {
-        return nil, fmt.Errorf("Could not create client: %s", err)
+/* Like WriteInterface, but splits multicast responses across as many packets
+ * as needed, and truncates the legacy unicast ones. */
+func WriteResponse(c *Conn, ifi *net.Interface, addr *net.UDPAddr, msg *Message) error {
+    if addr.Port != c.Group.Port {
+        return WriteTruncated(c, ifi, addr, msg, legacySize)
     }
-    defer client.Close()
-
-    seconds := 3 * time.Second
-    timeout := time.Now().Add(seconds)
 
-    err = Write(client, maddr, req)
+    parts, err := SplitMessage(msg, MaxMessageSize(c, ifi))
     if err != nil {
-        return nil, fmt.Errorf("Could not send request: %s", err)
+        return fmt.Errorf("Could not pack response: %s", err)
     }
 
-    client.SetReadDeadline(timeout)
-
-    rsp, _, _, _, _, err := Read(client)
-    if err != nil {
-        return nil, fmt.Errorf("Could not read response: %s", err)
+    for _, part := range parts {
+        err := WriteInterface(c, ifi, addr, part)
+        if err != nil {
+            return err
+        }
     }
 
-    if rsp.Header.Id != req.Header.Id {
-        return nil, fmt.Errorf("Wrong id: %d", rsp.Header.Id)
+    return nil
+}
+
+func WriteTruncated(c *Conn, ifi *net.Interface, addr *net.UDPAddr, msg *Message, size int) error {
+    rsp, err := TruncateMessage(msg, size)
+    if err != nil {
+        return fmt.Errorf("Could not pack response: %s", err)
     }
 
-    return rsp, nil
+    return WriteInterface(c, ifi, addr, rsp)
 }
 
 func SendRecursiveRequest(msg *Message, q *Question) uint16 {
@@ -229,111 +372,249 @@ func SendRecursiveRequest(msg *Message, q *Question) uint16 {
     return id
 }
 
-func Serve(p *ipv4.PacketConn, maddr *net.UDPAddr, localname string, silent, forward bool) {
-    var sent_id uint16
+func (s *Server) Serve() {
+    for _, c := range s.conns {
+        go s.Receive(c)
+    }
 
-    for {
-        req, local4, local6, client, loopback, err := Read(p)
-        if err != nil {
-            if silent != true {
-                log.Println("Error reading request: ", err)
-                continue
-            }
+    s.pending  = make(map[string]*query)
+    s.outgoing = make(map[outgoingKey]*outgoing)
+
+    if s.IsMulticast() {
+        if s.Services != nil {
+            /* announcing takes a while, don't hold up the caller */
+            s.Services.NotifyRegister(func(svc *Service) {
+                go s.ServiceAnnounce(svc)
+            })
+
+            s.Services.NotifyDeregister(s.ServiceGoodbye)
         }
 
-        if req.Header.Flags&FlagQR != 0 {
-            continue
+        s.Reprobe(false)
+    }
+
+    for {
+        var timer  *time.Timer
+        var wakeup <-chan time.Time
+
+        /* wake up in time to answer the pending queries */
+        next := s.NextDeadline()
+        if next.IsZero() != true {
+            timer  = time.NewTimer(time.Until(next))
+            wakeup = timer.C
         }
 
-        if sent_id > 0 && req.Header.Id == sent_id {
-            continue
+        var pkt *packet
+
+        select {
+        case pkt = <-s.packets:
+
+        case <-wakeup:
+
+        case <-s.done:
+            return
         }
 
-        rsp := new(Message)
+        if timer != nil {
+            timer.Stop()
+        }
 
-        rsp.Header.Flags |= FlagQR
-        rsp.Header.Flags |= FlagAA
+        s.FlushPending(time.Now())
 
-        if req.Header.Flags&FlagRD != 0 {
-            rsp.Header.Flags |= FlagRD
-            rsp.Header.Flags |= FlagRA
+        if pkt != nil {
+            s.Handle(pkt)
         }
+    }
+}
 
-        if client.Port != 5353 {
-            rsp.Header.Id = req.Header.Id
+func (s *Server) Handle(pkt *packet) {
+    if pkt.err != nil {
+        if s.Silent != true {
+            log.Println("Error reading request: ", pkt.err)
         }
 
-        for _, q := range req.Question {
-            switch q.Class {
-            case ClassInet:
-            case ClassInet | ClassUnicast:
-            case ClassAny:
+        return
+    }
 
-            default:
-                continue /* unsupport class */
-            }
+    /* probers need to see what comes in while they wait */
+    for _, ch := range s.Listeners() {
+        select {
+        case ch <- pkt:
 
-            if client.Port != 5353 {
-                rsp.Question = append(rsp.Question, q)
-                rsp.Header.QDCount++
-            }
+        default:
+        }
+    }
 
-            if string(q.Name) != localname {
-                if loopback && forward != false {
-                    sent_id = SendRecursiveRequest(rsp, q)
-                }
+    req := pkt.msg
 
-                continue
-            }
+    if req.Header.Flags&FlagQR != 0 {
+        /* conflicts found while probing are the prober's business */
+        if s.IsMulticast() && s.IsProbing() != true && s.HasConflict(req) {
+            s.Reprobe(true)
+        }
 
-            var rdata []RData
+        return
+    }
 
-            switch q.Type {
-            case TypeA:
-                rdata = append(rdata, NewA(local4.IP))
+    if s.sent_id > 0 && req.Header.Id == s.sent_id {
+        return
+    }
 
-            case TypeAAAA:
-                rdata = append(rdata, NewAAAA(local6.IP))
+    q := &query{
+        conn:     pkt.conn,
+        ifi:      pkt.ifi,
+        msg:      req,
+        local4:   pkt.local4,
+        local6:   pkt.local6,
+        client:   pkt.from,
+        loopback: pkt.loopback,
+        known:    req.Answer,
+    }
 
-            case TypeHINFO:
-                rdata = append(rdata, NewHINFO())
+    key := pkt.from.String()
 
-            case TypeAny:
-                rdata = append(rdata, NewA(local4.IP))
-                rdata = append(rdata, NewAAAA(local6.IP))
-                rdata = append(rdata, NewHINFO())
+    /* known answers that didn't fit in the first packet */
+    if pending, ok := s.pending[key]; ok && len(req.Question) == 0 {
+        pending.known = append(pending.known, req.Answer...)
+        return
+    }
 
-            default:
-                continue
-            }
+    if req.Header.Flags & FlagTC != 0 {
+        /* the querier is still sending the known answers of an earlier
+         * query, so answer both together */
+        if pending, ok := s.pending[key]; ok {
+            msg := *pending.msg
 
-            for _, rd := range rdata {
-                an := NewAN(q.Name, q.Class, 120, rd)
-                rsp.AppendAN(an)
-            }
-        }
+            msg.Question = append(append([]*Question{}, msg.Question...),
+                                  req.Question...)
+
+            msg.Header.QDCount = uint16(len(msg.Question))
 
-        if rsp.Header.ANCount       == 0 &&
-           rsp.Header.Flags.RCode() == RCodeNoError {
-            continue /* no answers and no error, skip */
+            pending.msg   = &msg
+            pending.known = append(pending.known, req.Answer...)
+            return
         }
 
-        if client.Port == 5353 {
-            client = maddr
+        delay := tcWait + time.Duration(rand.Int63n(int64(tcJitter)))
+
+        q.deadline     = time.Now().Add(delay)
+        s.pending[key] = q
+        return
+    }
+
+    s.Respond(q)
+}
+
+/* Probes for the name, after picking a new one if asked to, and announces it
+ * once it's ours. This happens in the background, so that the server keeps
+ * answering queries meanwhile, and only one probe runs at a time. */
+func (s *Server) Reprobe(rename bool) {
+    s.mutex.Lock()
+    defer s.mutex.Unlock()
+
+    if s.probing {
+        return
+    }
+
+    s.probing = true
+
+    go func() {
+        if rename {
+            s.Rename()
         }
 
-        err = Write(p, client, rsp)
+        probes := s.Listen()
+
+        err := s.Probe(probes)
+
+        s.Unlisten(probes)
+
+        s.mutex.Lock()
+        s.probing = false
+        s.mutex.Unlock()
+
         if err != nil {
-            if silent != true {
-                log.Println("Error sending response: ", err)
-                continue
+            if s.Silent != true {
+                log.Println("Error probing name: ", err)
             }
+
+            return
+        }
+
+        s.Announce()
+    }()
+}
+
+func (s *Server) IsProbing() bool {
+    s.mutex.Lock()
+    defer s.mutex.Unlock()
+
+    return s.probing
+}
+
+/* Returns a channel every packet received from now on is handed to, until
+ * Unlisten is called. Packets are dropped if the channel falls behind. */
+func (s *Server) Listen() chan *packet {
+    ch := make(chan *packet, probeQueue)
+
+    s.mutex.Lock()
+    defer s.mutex.Unlock()
+
+    if s.listeners == nil {
+        s.listeners = make(map[chan *packet]bool)
+    }
+
+    s.listeners[ch] = true
+
+    return ch
+}
+
+func (s *Server) Unlisten(ch chan *packet) {
+    s.mutex.Lock()
+    defer s.mutex.Unlock()
+
+    delete(s.listeners, ch)
+}
+
+func (s *Server) Listeners() []chan *packet {
+    s.mutex.Lock()
+    defer s.mutex.Unlock()
+
+    var chs []chan *packet
+
+    for ch := range s.listeners {
+        chs = append(chs, ch)
+    }
+
+    return chs
+}
+
+func HasTarget(msg *Message, name string) bool {
+    for _, rr := range append(msg.Answer, msg.Additional...) {
+        srv, ok := rr.RData.(*SRV)
+        if ok && IsSameName(srv.Target, name) {
+            return true
+        }
+    }
+
+    return false
+}
+
+func HasAddress(msg *Message, name string) bool {
+    for _, rr := range append(msg.Answer, msg.Additional...) {
+        if rr.Type == TypeA && IsSameName(rr.Name, name) {
+            return true
         }
     }
+
+    return false
 }
 
-func MonitorNetwork(p *ipv4.PacketConn, group net.Addr) error {
-    l, _ := netlink.ListenNetlink()
+func MonitorNetwork(c *Conn) error {
+    l, err := netlink.ListenNetlink()
+    if err != nil {
+        return fmt.Errorf("Could not listen netlink: %s", err)
+    }
 
     l.SendRouteRequest(syscall.RTM_GETADDR, syscall.AF_UNSPEC)
 
@@ -343,28 +624,38 @@ func MonitorNetwork(p *ipv4.PacketConn, group net.Addr) error {
             return fmt.Errorf("Could not read netlink: %s", err)
         }
 
+        /* interfaces are reported once per address, so failing to join
+         * a group we are already member of is expected */
         for _, m := range msgs {
             if netlink.IsNewAddr(&m) {
-                err := JoinGroup(p, &m, group)
-                if err != nil {
-                    return err
-                }
+                JoinGroup(c, &m)
             }
 
             if netlink.IsDelAddr(&m) {
-                err := LeaveGroup(p, &m, group)
-                if err != nil {
-                    return err
-                }
+                LeaveGroup(c, &m)
             }
         }
     }
 }
 
-func JoinGroup(p *ipv4.PacketConn, msg *syscall.NetlinkMessage, group net.Addr) error {
+func IsSameFamily(c *Conn, ifaddrmsg *syscall.IfAddrmsg) bool {
+    if c.IsIPv6() {
+        return ifaddrmsg.Family == syscall.AF_INET6
+    }
+
+    return ifaddrmsg.Family == syscall.AF_INET
+}
+
+func JoinGroup(c *Conn, msg *syscall.NetlinkMessage) error {
     ifaddrmsg := (*syscall.IfAddrmsg)(unsafe.Pointer(&msg.Data[0]))
 
-    if netlink.IsRelevant(ifaddrmsg) != true {
+    if IsSameFamily(c, ifaddrmsg) != true {
+        return nil
+    }
+
+    /* IPv6 links may well have link-local addresses only */
+    if netlink.IsRelevant(ifaddrmsg) != true &&
+       (c.IsIPv6() != true || netlink.IsLinkLocal(ifaddrmsg) != true) {
         return nil
     }
 
@@ -373,7 +664,7 @@ func JoinGroup(p *ipv4.PacketConn, msg *syscall.NetlinkMessage, group net.Addr)
         return fmt.Errorf("Could not get interface: %s", err)
     }
 
-    err = p.JoinGroup(ifi, group)
+    err = c.JoinGroup(ifi)
     if err != nil {
         return fmt.Errorf("Could not join group: %s", err)
     }
@@ -381,15 +672,29 @@ func JoinGroup(p *ipv4.PacketConn, msg *syscall.NetlinkMessage, group net.Addr)
     return nil
 }
 
-func LeaveGroup(p *ipv4.PacketConn, msg *syscall.NetlinkMessage, group net.Addr) error {
+func LeaveGroup(c *Conn, msg *syscall.NetlinkMessage) error {
     ifaddrmsg := (*syscall.IfAddrmsg)(unsafe.Pointer(&msg.Data[0]))
 
+    if IsSameFamily(c, ifaddrmsg) != true {
+        return nil
+    }
+
     ifi, err := net.InterfaceByIndex(int(ifaddrmsg.Index))
     if err != nil {
         return fmt.Errorf("Could not get interface: %s", err)
     }
 
-    err = p.LeaveGroup(ifi, group)
+    local4, local6, err := InterfaceAddrs(ifi)
+    if err != nil {
+        return err
+    }
+
+    /* stay in the group as long as the interface has other addresses */
+    if c.HasFamily(local4, local6) {
+        return nil
+    }
+
+    err = c.LeaveGroup(ifi)
     if err != nil {
         return fmt.Errorf("Could not leave group: %s", err)
     }
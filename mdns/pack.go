@@ -30,146 +30,144 @@
 
 package mdns
 
-import "bytes"
 import "encoding/binary"
 import "fmt"
-import "io"
-import "reflect"
+import "strings"
+import "sync"
+
+/* most messages are small, so buffers start at the plain DNS size and grow
+ * as needed while being reused */
+var packPool = sync.Pool{
+    New: func() interface{} {
+        b := make([]byte, 0, legacySize)
+        return &b
+    },
+}
+
+func GetBuffer() *[]byte {
+    return packPool.Get().(*[]byte)
+}
+
+func PutBuffer(b *[]byte) {
+    *b = (*b)[:0]
+    packPool.Put(b)
+}
 
 func Pack(msg *Message) ([]byte, error) {
-    b := bytes.NewBuffer([]byte{})
+    buf := GetBuffer()
+    defer PutBuffer(buf)
 
-    err := PackStruct(b, &msg.Header)
+    b, err := PackBuffer(*buf, msg)
     if err != nil {
-        return nil, fmt.Errorf("Could not pack header: %s", err)
+        return nil, err
     }
 
+    *buf = b
+
+    pkt := make([]byte, len(b))
+    copy(pkt, b)
+
+    return pkt, nil
+}
+
+/* Packs the message reusing the storage of b, and returns the packed slice,
+ * which is only valid until b is reused. */
+func PackBuffer(b []byte, msg *Message) ([]byte, error) {
+    var err error
+
+    b = b[:0]
+
+    names := make(map[string]int)
+
+    b = msg.Header.Pack(b)
+
     for i := uint16(0); i < msg.Header.QDCount; i++ {
-        err := PackStruct(b, msg.Question[i])
+        b, err = msg.Question[i].Pack(b, names)
         if err != nil {
             return nil, fmt.Errorf("Could not pack qd: %s", err)
         }
     }
 
     for i := uint16(0); i < msg.Header.ANCount; i++ {
-        err := PackStruct(b, msg.Answer[i])
+        b, err = msg.Answer[i].Pack(b, names)
         if err != nil {
             return nil, fmt.Errorf("Could not pack an: %s", err)
         }
     }
 
     for i := uint16(0); i < msg.Header.NSCount; i++ {
-        err := PackStruct(b, msg.Authority[i])
+        b, err = msg.Authority[i].Pack(b, names)
         if err != nil {
             return nil, fmt.Errorf("Could not pack ns: %s", err)
         }
     }
 
     for i := uint16(0); i < msg.Header.ARCount; i++ {
-        err := PackStruct(b, msg.Additional[i])
+        b, err = msg.Additional[i].Pack(b, names)
         if err != nil {
             return nil, fmt.Errorf("Could not pack ar: %s", err)
         }
     }
 
-    return b.Bytes(), nil
+    return b, nil
 }
 
-func PackStruct(r io.Writer, data interface{}) error {
-    value := reflect.ValueOf(data).Elem()
-
-    for i := 0; i < value.NumField(); i++ {
-        field := value.Field(i)
-        kind  := field.Kind()
-        tag   := value.Type().Field(i).Tag
-
-        switch {
-        case tag == `mdns:"name"`:
-            name := field.Bytes()
-
-            err := PackName(r, name)
-            if err != nil {
-                return fmt.Errorf("name: %s", err)
-            }
-
-        case tag == `mdns:"a"` || tag == `mdns:"aaaa"`:
-            for i := 0; i < field.Len(); i++ {
-                b := byte(field.Index(i).Uint())
-
-                err := binary.Write(
-                    r, binary.BigEndian, &b,
-                )
-
-                if err != nil {
-                    return fmt.Errorf("write: %s", err)
-                }
-            }
-
-        case kind == reflect.Uint16:
-            v := uint16(field.Uint())
-
-            err := binary.Write(r, binary.BigEndian, &v)
-            if err != nil {
-                return fmt.Errorf("write: %s", err)
-            }
-
-        case kind == reflect.Uint32:
-            v := uint32(field.Uint())
-
-            err := binary.Write(r, binary.BigEndian, &v)
-            if err != nil {
-                return fmt.Errorf("write: %s", err)
-            }
-
-        case kind == reflect.String:
-            str := field.String()
-
-            err := PackString(r, str)
-            if err != nil {
-                return fmt.Errorf("string: %s", err)
-            }
-
-        case kind == reflect.Interface || kind == reflect.Struct:
-            err := PackStruct(r, field.Interface())
-            if err != nil {
-                return fmt.Errorf("struct: %s", err)
-            }
-        }
-    }
+func PackUint16(b []byte, v uint16) []byte {
+    return binary.BigEndian.AppendUint16(b, v)
+}
 
-    return nil
+func PackUint32(b []byte, v uint32) []byte {
+    return binary.BigEndian.AppendUint32(b, v)
 }
 
-func PackName(w io.Writer, name []byte) error {
-    for _, label := range bytes.Split(name, []byte{'.'}) {
-        l := uint8(len(label))
+/* Names are compressed against the ones already in the message, unless the
+ * names table is nil. */
+func PackName(b []byte, names map[string]int, name []byte) ([]byte, error) {
+    labels, err := SplitName(name)
+    if err != nil {
+        return nil, err
+    }
 
-        err := binary.Write(w, binary.BigEndian, &l)
-        if err != nil {
-            return fmt.Errorf("write: %s", err)
+    wire := 1
+
+    for _, label := range labels {
+        wire += 1 + len(label)
+    }
+
+    if wire > maxNameLen {
+        return nil, ErrNameTooLong
+    }
+
+    for i, label := range labels {
+        suffix := strings.ToLower(string(JoinName(labels[i:])))
+
+        if off, ok := names[suffix]; ok {
+            return PackUint16(b, uint16(0xC000 | off)), nil
         }
 
-        err = binary.Write(w, binary.BigEndian, label)
-        if err != nil {
-            return fmt.Errorf("write: %s", err)
+        /* pointers only have 14 bits for the offset */
+        if names != nil && len(b) <= 0x3FFF {
+            names[suffix] = len(b)
+        }
+
+        if len(label) == 0 || len(label) > maxLabelLen {
+            return nil, fmt.Errorf("invalid label length: %d", len(label))
         }
+
+        b = append(b, uint8(len(label)))
+        b = append(b, label...)
     }
 
-    return nil
+    return append(b, 0), nil
 }
 
-func PackString(w io.Writer, str string) error {
-    l := uint8(len(str))
-
-    err := binary.Write(w, binary.BigEndian, &l)
-    if err != nil {
-        return fmt.Errorf("write: %s", err)
+func PackString(b []byte, str string) ([]byte, error) {
+    if len(str) > 255 {
+        return nil, fmt.Errorf("string too long: %d", len(str))
     }
 
-    err = binary.Write(w, binary.BigEndian, []byte(str))
-    if err != nil {
-        return fmt.Errorf("write: %s", err)
-    }
+    b = append(b, uint8(len(str)))
+    b = append(b, str...)
 
-    return nil
+    return b, nil
 }
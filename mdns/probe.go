@@ -0,0 +1,716 @@
+/*
+ * Minimal multicast DNS server.
+ *
+ * Copyright (c) 2014, Alessandro Ghedini
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are
+ * met:
+ *
+ *     * Redistributions of source code must retain the above copyright
+ *       notice, this list of conditions and the following disclaimer.
+ *
+ *     * Redistributions in binary form must reproduce the above copyright
+ *       notice, this list of conditions and the following disclaimer in the
+ *       documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS
+ * IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO,
+ * THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR
+ * PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR
+ * CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL,
+ * EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+ * PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+ * PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF
+ * LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING
+ * NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+ * SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package mdns
+
+import "bytes"
+import "fmt"
+import "log"
+import "math/rand"
+import "net"
+import "sort"
+import "strings"
+import "time"
+
+const probeCount    = 3
+const probeWait     = 250 * time.Millisecond
+const announceCount = 2
+const announceWait  = 1 * time.Second
+
+const conflictStormWait = 5 * time.Second
+const maxConflicts      = 15
+
+/* packets the prober can lag behind the server by */
+const probeQueue = 64
+
+const (
+    probeDone = iota
+    probeConflict
+)
+
+func HostRecords(name string, local4, local6 *net.IPNet) []*Record {
+    var rrs []*Record
+
+    if local4 != nil {
+        rrs = append(rrs, NewAN([]byte(name), ClassInet | ClassCacheFlush,
+                                hostTTL, NewA(local4.IP)))
+    }
+
+    if local6 != nil {
+        rrs = append(rrs, NewAN([]byte(name), ClassInet | ClassCacheFlush,
+                                hostTTL, NewAAAA(local6.IP)))
+    }
+
+    return rrs
+}
+
+/* Returns the NSEC record listing the types that exist for our name. */
+func HostNSEC(name []byte, local4, local6 *net.IPNet) *Record {
+    var types []Type
+
+    if local4 != nil {
+        types = append(types, TypeA)
+    }
+
+    types = append(types, TypeHINFO)
+
+    if local6 != nil {
+        types = append(types, TypeAAAA)
+    }
+
+    return NewAN(name, ClassInet | ClassCacheFlush, hostTTL,
+                 NewNSEC(string(name), types))
+}
+
+func (s *Server) Probe(probes <-chan *packet) error {
+    for {
+        state, err := s.ProbeOnce(probes)
+        if err != nil {
+            return err
+        }
+
+        switch state {
+        case probeDone:
+            return nil
+
+        case probeConflict:
+            s.Rename()
+        }
+    }
+}
+
+func (s *Server) ProbeOnce(probes <-chan *packet) (int, error) {
+    ifis, err := MulticastInterfaces()
+    if err != nil {
+        return probeDone, err
+    }
+
+    time.Sleep(time.Duration(rand.Int63n(int64(probeWait))))
+
+    name := s.LocalName()
+
+    for i := 0; i < probeCount; i++ {
+        for _, ifi := range ifis {
+            local4, local6, err := InterfaceAddrs(&ifi)
+            if err != nil {
+                return probeDone, err
+            }
+
+            class := Class(ClassInet)
+
+            /* ask for unicast responses on the first probe only */
+            if i == 0 {
+                class |= ClassUnicast
+            }
+
+            probe := new(Message)
+
+            probe.AppendQD(NewQD([]byte(name), TypeAny, class))
+
+            rrs := HostRecords(name, local4, local6)
+
+            for _, rr := range ClearCacheFlush(rrs) {
+                probe.AppendNS(rr)
+            }
+
+            err = s.WriteMulticast(&ifi, local4, local6, probe)
+            if err != nil {
+                return probeDone, fmt.Errorf("Could not send probe: %s", err)
+            }
+        }
+
+        state := s.WaitConflict(probes, probeWait)
+        if state != probeDone {
+            return state, nil
+        }
+    }
+
+    return probeDone, nil
+}
+
+/* Watches the packets handed over by the server for anyone else claiming
+ * the name. */
+func (s *Server) WaitConflict(probes <-chan *packet, timeout time.Duration) int {
+    wakeup := time.After(timeout)
+
+    name := s.LocalName()
+
+    for {
+        var pkt *packet
+
+        select {
+        case pkt = <-probes:
+
+        case <-wakeup:
+            return probeDone
+
+        case <-s.done:
+            return probeDone
+        }
+
+        if pkt.err != nil {
+            continue
+        }
+
+        msg := pkt.msg
+
+        if msg.Header.Flags & FlagQR != 0 {
+            if s.HasConflict(msg) {
+                return probeConflict
+            }
+
+            continue
+        }
+
+        ours := HostRecords(name, pkt.local4, pkt.local6)
+
+        if IsProbeFor(msg, name) &&
+           CompareRecords(ours, ProbeRecords(msg, name)) < 0 {
+            /* we lost a simultaneous probe tiebreak, so leave the
+             * name to the winner */
+            return probeConflict
+        }
+    }
+}
+
+func (s *Server) HasConflict(msg *Message) bool {
+    for _, rr := range append(msg.Answer, msg.Additional...) {
+        if s.IsConflict(rr) {
+            return true
+        }
+    }
+
+    return false
+}
+
+func (s *Server) IsConflict(rr *Record) bool {
+    if IsSameName(rr.Name, s.LocalName()) != true {
+        return false
+    }
+
+    var addr net.IP
+
+    switch rd := rr.RData.(type) {
+    case *A:
+        addr = rd.Addr
+
+    case *AAAA:
+        addr = rd.Addr
+
+    default:
+        return false
+    }
+
+    return s.Owns(addr) != true
+}
+
+func (s *Server) Owns(addr net.IP) bool {
+    addrs, err := net.InterfaceAddrs()
+    if err != nil {
+        return false
+    }
+
+    for _, a := range addrs {
+        if a.(*net.IPNet).IP.Equal(addr) {
+            return true
+        }
+    }
+
+    return false
+}
+
+func (s *Server) LocalName() string {
+    s.mutex.Lock()
+    defer s.mutex.Unlock()
+
+    return s.Name
+}
+
+func (s *Server) Rename() {
+    s.mutex.Lock()
+
+    old := s.Name
+
+    if s.orig_name == "" {
+        s.orig_name = s.Name
+    }
+
+    s.conflicts++
+
+    conflicts := s.conflicts
+    orig_name := s.orig_name
+
+    s.mutex.Unlock()
+
+    /* rate limit probing when the network is in a conflict storm */
+    if conflicts % maxConflicts == 0 {
+        time.Sleep(conflictStormWait)
+    }
+
+    labels := strings.SplitN(orig_name, ".", 2)
+    if len(labels) < 2 {
+        labels = append(labels, "")
+    }
+
+    name := fmt.Sprintf("%s-%d.%s", labels[0], conflicts + 1, labels[1])
+
+    s.mutex.Lock()
+    s.Name = name
+    s.mutex.Unlock()
+
+    if s.Silent != true {
+        log.Printf("Name '%s' already in use, renaming to '%s'", old, name)
+    }
+
+    if s.OnConflict != nil {
+        s.OnConflict(old, name)
+    }
+}
+
+func IsProbeFor(msg *Message, name string) bool {
+    for _, q := range msg.Question {
+        if IsSameName(q.Name, name) && q.Type == TypeAny {
+            return len(ProbeRecords(msg, name)) > 0
+        }
+    }
+
+    return false
+}
+
+func ProbeRecords(msg *Message, name string) []*Record {
+    var rrs []*Record
+
+    for _, rr := range msg.Authority {
+        if IsSameName(rr.Name, name) {
+            rrs = append(rrs, rr)
+        }
+    }
+
+    return rrs
+}
+
+func CompareRecords(ours, theirs []*Record) int {
+    ours   = SortRecords(ours)
+    theirs = SortRecords(theirs)
+
+    for i := 0; i < len(ours) && i < len(theirs); i++ {
+        c := CompareRecord(ours[i], theirs[i])
+        if c != 0 {
+            return c
+        }
+    }
+
+    return len(ours) - len(theirs)
+}
+
+func SortRecords(rrs []*Record) []*Record {
+    sorted := append([]*Record(nil), rrs...)
+
+    sort.Slice(sorted, func(i, j int) bool {
+        return CompareRecord(sorted[i], sorted[j]) < 0
+    })
+
+    return sorted
+}
+
+func CompareRecord(a, b *Record) int {
+    class_a := a.Class &^ ClassCacheFlush
+    class_b := b.Class &^ ClassCacheFlush
+
+    if class_a != class_b {
+        return int(class_a) - int(class_b)
+    }
+
+    if a.Type != b.Type {
+        return int(a.Type) - int(b.Type)
+    }
+
+    return bytes.Compare(RawRData(a), RawRData(b))
+}
+
+func IsSameRData(a, b *Record) bool {
+    return a.Type == b.Type && bytes.Equal(RawRData(a), RawRData(b))
+}
+
+func RawRData(rr *Record) []byte {
+    if rr.RData == nil {
+        return nil
+    }
+
+    /* no compression table, tiebreaks compare uncompressed rdata */
+    b, err := rr.RData.Pack(nil, nil)
+    if err != nil {
+        return nil
+    }
+
+    return b
+}
+
+func (s *Server) OwnedRecords(local4, local6 *net.IPNet) []*Record {
+    name := s.LocalName()
+
+    rrs := HostRecords(name, local4, local6)
+
+    if s.Services != nil {
+        rrs = append(rrs, s.Services.Records(name)...)
+    }
+
+    return rrs
+}
+
+func (s *Server) Announce() {
+    for i := 0; i < announceCount; i++ {
+        if i > 0 {
+            time.Sleep(announceWait)
+        }
+
+        err := s.MulticastRecords(s.OwnedRecords)
+        if err != nil && s.Silent != true {
+            log.Println("Error sending announcement: ", err)
+        }
+    }
+}
+
+func (s *Server) Goodbye() error {
+    return s.MulticastRecords(func(local4, local6 *net.IPNet) []*Record {
+        return Expire(s.OwnedRecords(local4, local6))
+    })
+}
+
+func (s *Server) ServiceAnnounce(svc *Service) {
+    s.SetProbing(svc, true)
+    defer s.SetProbing(svc, false)
+
+    ok, err := s.ProbeService(svc)
+    if err != nil {
+        if s.Silent != true {
+            log.Println("Error probing service: ", err)
+        }
+
+        return
+    }
+
+    /* someone else has the name, so stop answering for it */
+    if ok != true {
+        if s.Silent != true {
+            log.Printf("Service '%s' already in use", svc.InstanceName())
+        }
+
+        s.Services.Deregister(svc)
+        return
+    }
+
+    s.SetProbing(svc, false)
+
+    name := s.LocalName()
+
+    rrs := append(svc.Records(name), svc.MetaRecord())
+
+    for i := 0; i < announceCount; i++ {
+        if i > 0 {
+            time.Sleep(announceWait)
+        }
+
+        if s.IsClosed() {
+            return
+        }
+
+        err := s.MulticastRecords(func(local4, local6 *net.IPNet) []*Record {
+            return rrs
+        })
+
+        if err != nil && s.Silent != true {
+            log.Println("Error sending announcement: ", err)
+        }
+    }
+}
+
+/* Probes for the name of a service instance, RFC 6762 §8.1, and returns
+ * false if it belongs to someone else. */
+func (s *Server) ProbeService(svc *Service) (bool, error) {
+    probes := s.Listen()
+    defer s.Unlisten(probes)
+
+    ifis, err := MulticastInterfaces()
+    if err != nil {
+        return false, err
+    }
+
+    time.Sleep(time.Duration(rand.Int63n(int64(probeWait))))
+
+    name := svc.InstanceName()
+    ours := svc.records(s.LocalName())
+
+    for i := 0; i < probeCount; i++ {
+        if s.IsClosed() {
+            return false, nil
+        }
+
+        for _, ifi := range ifis {
+            local4, local6, err := InterfaceAddrs(&ifi)
+            if err != nil {
+                return false, err
+            }
+
+            class := Class(ClassInet)
+
+            /* ask for unicast responses on the first probe only */
+            if i == 0 {
+                class |= ClassUnicast
+            }
+
+            probe := new(Message)
+
+            probe.AppendQD(NewQD([]byte(name), TypeAny, class))
+
+            for _, rr := range ClearCacheFlush(ours) {
+                probe.AppendNS(rr)
+            }
+
+            err = s.WriteMulticast(&ifi, local4, local6, probe)
+            if err != nil {
+                return false, fmt.Errorf("Could not send probe: %s", err)
+            }
+        }
+
+        if s.WaitServiceConflict(probes, name, ours, probeWait) {
+            return false, nil
+        }
+    }
+
+    return true, nil
+}
+
+/* Marks the service as being probed for, so that it isn't answered for
+ * meanwhile. */
+func (s *Server) SetProbing(svc *Service, probing bool) {
+    s.mutex.Lock()
+    defer s.mutex.Unlock()
+
+    if s.instances == nil {
+        s.instances = make(map[string]bool)
+    }
+
+    name := strings.ToLower(svc.InstanceName())
+
+    if probing {
+        s.instances[name] = true
+    } else {
+        delete(s.instances, name)
+    }
+}
+
+/* Leaves out the records of the service instances still being probed for,
+ * and the PTRs pointing at them. */
+func (s *Server) Probed(rrs []*Record) []*Record {
+    s.mutex.Lock()
+    defer s.mutex.Unlock()
+
+    var probed []*Record
+
+    for _, rr := range rrs {
+        name := string(rr.Name)
+
+        if ptr, ok := rr.RData.(*PTR); ok {
+            name = string(ptr.PTRNAME)
+        }
+
+        if s.instances[strings.ToLower(name)] {
+            continue
+        }
+
+        probed = append(probed, rr)
+    }
+
+    return probed
+}
+
+/* Returns true if anyone answers for the service instance name with other
+ * records than ours, or wins a simultaneous probe for it. */
+func (s *Server) WaitServiceConflict(probes <-chan *packet, name string, ours []*Record, timeout time.Duration) bool {
+    wakeup := time.After(timeout)
+
+    for {
+        var pkt *packet
+
+        select {
+        case pkt = <-probes:
+
+        case <-wakeup:
+            return false
+
+        case <-s.done:
+            return false
+        }
+
+        if pkt.err != nil {
+            continue
+        }
+
+        msg := pkt.msg
+
+        if msg.Header.Flags & FlagQR == 0 {
+            if IsProbeFor(msg, name) &&
+               CompareRecords(ours, ProbeRecords(msg, name)) < 0 {
+                return true
+            }
+
+            continue
+        }
+
+        for _, rr := range append(msg.Answer, msg.Additional...) {
+            if IsSameName(rr.Name, name) != true || HasRecord(ours, rr) {
+                continue
+            }
+
+            if rr.Type == TypeSRV || rr.Type == TypeTXT {
+                return true
+            }
+        }
+    }
+}
+
+func (s *Server) ServiceGoodbye(svc *Service) {
+    if s.IsClosed() {
+        return
+    }
+
+    name := s.LocalName()
+
+    rrs := svc.Records(name)
+
+    /* nothing was sent for a service that lost its name while probing */
+    if len(s.Probed(rrs)) == 0 {
+        return
+    }
+
+    /* the service type goes away with its last instance */
+    if s.Services.HasService(svc.ServiceName()) != true {
+        rrs = append(rrs, svc.MetaRecord())
+    }
+
+    err := s.MulticastRecords(func(local4, local6 *net.IPNet) []*Record {
+        return Expire(rrs)
+    })
+
+    if err != nil && s.Silent != true {
+        log.Println("Error sending goodbye: ", err)
+    }
+}
+
+func (s *Server) MulticastRecords(records func(local4, local6 *net.IPNet) []*Record) error {
+    ifis, err := MulticastInterfaces()
+    if err != nil {
+        return err
+    }
+
+    for _, ifi := range ifis {
+        local4, local6, err := InterfaceAddrs(&ifi)
+        if err != nil {
+            return err
+        }
+
+        rsp := new(Message)
+
+        rsp.Header.Flags |= FlagQR
+        rsp.Header.Flags |= FlagAA
+
+        for _, rr := range records(local4, local6) {
+            rsp.AppendAN(rr)
+        }
+
+        if rsp.Header.ANCount == 0 {
+            continue
+        }
+
+        err = s.WriteMulticast(&ifi, local4, local6, rsp)
+        if err != nil {
+            return err
+        }
+    }
+
+    return nil
+}
+
+func (s *Server) WriteMulticast(ifi *net.Interface, local4, local6 *net.IPNet, msg *Message) error {
+    for _, c := range s.conns {
+        /* nothing to send on if the interface lacks that family */
+        if c.HasFamily(local4, local6) != true {
+            continue
+        }
+
+        var err error
+
+        if msg.Header.Flags & FlagQR != 0 {
+            err = WriteResponse(c, ifi, c.Group, msg)
+        } else {
+            err = WriteInterface(c, ifi, c.Group, msg)
+        }
+
+        if err != nil {
+            return err
+        }
+
+        if msg.Header.Flags & FlagQR != 0 {
+            var rrs []*Record
+
+            rrs = append(rrs, msg.Answer...)
+            rrs = append(rrs, msg.Additional...)
+
+            s.history.Add(c, ifi, rrs, time.Now())
+        }
+    }
+
+    return nil
+}
+
+func Expire(rrs []*Record) []*Record {
+    for _, rr := range rrs {
+        rr.TTL = 0
+    }
+
+    return rrs
+}
+
+/* Returns copies of the records without the cache-flush bit, which is only
+ * meant for the answers of multicast responses, RFC 6762 §10.2. */
+func ClearCacheFlush(rrs []*Record) []*Record {
+    var clear []*Record
+
+    for _, rr := range rrs {
+        c := *rr
+
+        c.Class &^= ClassCacheFlush
+
+        clear = append(clear, &c)
+    }
+
+    return clear
+}
@@ -0,0 +1,506 @@
+/*
+ * Minimal multicast DNS server.
+ *
+ * Copyright (c) 2014, Alessandro Ghedini
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are
+ * met:
+ *
+ *     * Redistributions of source code must retain the above copyright
+ *       notice, this list of conditions and the following disclaimer.
+ *
+ *     * Redistributions in binary form must reproduce the above copyright
+ *       notice, this list of conditions and the following disclaimer in the
+ *       documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS
+ * IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO,
+ * THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR
+ * PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR
+ * CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL,
+ * EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+ * PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+ * PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF
+ * LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING
+ * NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+ * SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package mdns
+
+import "log"
+import "math/rand"
+import "net"
+import "time"
+
+const tcWait   = 400 * time.Millisecond
+const tcJitter = 100 * time.Millisecond
+
+/* answers with shared records are delayed by 20-120ms, RFC 6762 §6 */
+const sharedWait   = 20 * time.Millisecond
+const sharedJitter = 100 * time.Millisecond
+
+/* minimum interval between multicasts of the same record on an interface */
+const multicastRate = 1 * time.Second
+
+type query struct {
+    conn     *Conn
+    ifi      *net.Interface
+    msg      *Message
+    local4   *net.IPNet
+    local6   *net.IPNet
+    client   *net.UDPAddr
+    loopback bool
+    known    []*Record
+    deadline time.Time
+}
+
+type outgoingKey struct {
+    conn    *Conn
+    ifindex int
+}
+
+/* Multicast answers waiting to be sent on an interface, aggregated from
+ * all the queries received in the meantime. */
+type outgoing struct {
+    qry        *query
+    answers    []*Record
+    additional []*Record
+    deadline   time.Time
+}
+
+func (s *Server) NextDeadline() time.Time {
+    var next time.Time
+
+    for _, q := range s.pending {
+        if next.IsZero() || q.deadline.Before(next) {
+            next = q.deadline
+        }
+    }
+
+    for _, out := range s.outgoing {
+        if next.IsZero() || out.deadline.Before(next) {
+            next = out.deadline
+        }
+    }
+
+    return next
+}
+
+func (s *Server) FlushPending(now time.Time) {
+    for key, q := range s.pending {
+        if now.Before(q.deadline) {
+            continue
+        }
+
+        delete(s.pending, key)
+
+        s.Respond(q)
+    }
+
+    for key, out := range s.outgoing {
+        if now.Before(out.deadline) {
+            continue
+        }
+
+        delete(s.outgoing, key)
+
+        s.SendMulticast(out)
+    }
+}
+
+func NewResponse(req *Message, client *net.UDPAddr) *Message {
+    rsp := new(Message)
+
+    rsp.Header.Flags |= FlagQR
+    rsp.Header.Flags |= FlagAA
+
+    if req.Header.Flags&FlagRD != 0 {
+        rsp.Header.Flags |= FlagRD
+        rsp.Header.Flags |= FlagRA
+    }
+
+    if client.Port != 5353 {
+        rsp.Header.Id = req.Header.Id
+    }
+
+    return rsp
+}
+
+/* Returns the answers to the query, without the ones the querier already
+ * knows about. */
+func (s *Server) MakeResponse(qry *query) *Message {
+    req      := qry.msg
+    local4   := qry.local4
+    local6   := qry.local6
+    client   := qry.client
+    loopback := qry.loopback
+
+    rsp := NewResponse(req, client)
+
+    name := s.LocalName()
+
+    /* the name isn't ours to answer for until probing is over */
+    probing := s.IsProbing()
+
+    for _, q := range req.Question {
+        switch q.Class {
+        case ClassInet:
+        case ClassInet | ClassUnicast:
+        case ClassAny:
+
+        default:
+            continue /* unsupport class */
+        }
+
+        if client.Port != 5353 {
+            rsp.Question = append(rsp.Question, q)
+            rsp.Header.QDCount++
+        }
+
+        if s.Services != nil {
+            an, ar := s.Services.Answer(q, name)
+
+            for _, rr := range s.Probed(an) {
+                rsp.AppendAN(rr)
+            }
+
+            for _, rr := range s.Probed(ar) {
+                rsp.AppendAR(rr)
+            }
+        }
+
+        if (q.Type == TypePTR || q.Type == TypeAny) && probing != true {
+            for _, rr := range ReverseRecords(q.Name, name, qry.ifi) {
+                rsp.AppendAN(rr)
+            }
+        }
+
+        if IsSameName(q.Name, name) != true {
+            if rsp.Header.ANCount == 0 && loopback && s.Forward {
+                s.sent_id = SendRecursiveRequest(rsp, q)
+            }
+
+            continue
+        }
+
+        if probing {
+            continue
+        }
+
+        var rdata []RData
+
+        if (q.Type == TypeA || q.Type == TypeAny) && local4 != nil {
+            rdata = append(rdata, NewA(local4.IP))
+        }
+
+        if (q.Type == TypeAAAA || q.Type == TypeAny) && local6 != nil {
+            rdata = append(rdata, NewAAAA(local6.IP))
+        }
+
+        if q.Type == TypeHINFO || q.Type == TypeAny {
+            rdata = append(rdata, NewHINFO())
+        }
+
+        for _, rd := range rdata {
+            an := NewAN(q.Name, ClassInet | ClassCacheFlush, hostTTL, rd)
+            rsp.AppendAN(an)
+        }
+
+        nsec := HostNSEC(q.Name, local4, local6)
+
+        switch {
+        /* assert the nonexistence of the type we've been asked for, so
+         * that the querier doesn't keep asking, RFC 6762 §6.1 */
+        case len(rdata) == 0:
+            rsp.AppendAN(nsec)
+
+        /* along with an address, tell about the other family too */
+        case q.Type == TypeA && local6 == nil,
+             q.Type == TypeAAAA && local4 == nil:
+            rsp.AppendAR(nsec)
+        }
+    }
+
+    if probing != true &&
+       HasTarget(rsp, name) && HasAddress(rsp, name) != true {
+        for _, rr := range HostRecords(name, local4, local6) {
+            rsp.AppendAR(rr)
+        }
+    }
+
+    rsp.Answer     = SuppressKnown(rsp.Answer, qry.known)
+    rsp.Additional = SuppressKnown(rsp.Additional, qry.known)
+
+    rsp.Header.ANCount = uint16(len(rsp.Answer))
+    rsp.Header.ARCount = uint16(len(rsp.Additional))
+
+    return rsp
+}
+
+func (s *Server) Respond(qry *query) {
+    req    := qry.msg
+    client := qry.client
+
+    edns := FindEDNS(req)
+
+    /* only legacy queriers get to negotiate EDNS */
+    if edns != nil && client.Port != 5353 {
+        if EDNSVersion(edns) > ednsVersion {
+            rsp := NewResponse(req, client)
+
+            rsp.AppendAR(NewEDNS(ednsSize, ExtRCodeBadVers, false))
+
+            s.SendResponse(qry, client, rsp)
+            return
+        }
+    }
+
+    rsp := s.MakeResponse(qry)
+
+    if rsp.Header.ANCount       == 0 &&
+       rsp.Header.Flags.RCode() == RCodeNoError {
+        return /* no answers and no error, skip */
+    }
+
+    /* legacy unicast queries always get a unicast response */
+    if client.Port != 5353 {
+        rsp.Answer     = ClearCacheFlush(rsp.Answer)
+        rsp.Additional = ClearCacheFlush(rsp.Additional)
+
+        if edns != nil {
+            rsp.AppendAR(NewEDNS(ednsSize, 0, false))
+        }
+
+        s.SendResponse(qry, client, rsp)
+        return
+    }
+
+    /* QU questions are answered via unicast, unless the record wasn't
+     * multicast on the interface recently, RFC 6762 §5.4 */
+    var unicast, multicast []*Record
+
+    now := time.Now()
+
+    /* unicast to port 5353 on this host could be delivered to any of the
+     * sockets sharing it, ours included */
+    local := s.Owns(client.IP)
+
+    for _, rr := range rsp.Answer {
+        if local != true && IsUnicastAnswer(req, rr) &&
+           s.history.IsRecent(qry.conn, qry.ifi, rr, now) {
+            unicast = append(unicast, rr)
+        } else {
+            multicast = append(multicast, rr)
+        }
+    }
+
+    additional := rsp.Additional
+
+    if len(unicast) > 0 {
+        ursp := *rsp
+
+        ursp.Answer = unicast
+
+        /* the additional records go with the multicast response if any */
+        if len(multicast) > 0 {
+            ursp.Additional = nil
+        }
+
+        ursp.Header.ANCount = uint16(len(ursp.Answer))
+        ursp.Header.ARCount = uint16(len(ursp.Additional))
+
+        s.SendResponse(qry, client, &ursp)
+    }
+
+    if len(multicast) > 0 {
+        s.QueueMulticast(qry, multicast, additional, IsProbe(req), now)
+    }
+}
+
+/* Schedules the answers to be multicast on the query's interface, merging
+ * them with any other answers already waiting there. */
+func (s *Server) QueueMulticast(qry *query, an, ar []*Record, probe bool, now time.Time) {
+    var delay time.Duration
+
+    /* probes are defended right away, anything else is rate limited */
+    if probe != true {
+        var keep []*Record
+
+        for _, rr := range an {
+            sent := s.history.LastSent(qry.conn, qry.ifi, rr)
+
+            if sent.IsZero() || now.Sub(sent) >= multicastRate {
+                keep = append(keep, rr)
+            }
+        }
+
+        if len(keep) == 0 {
+            return
+        }
+
+        an = keep
+
+        if HasShared(an) {
+            delay = sharedWait + time.Duration(rand.Int63n(int64(sharedJitter)))
+        }
+    }
+
+    key := outgoingKey{ conn: qry.conn }
+
+    if qry.ifi != nil {
+        key.ifindex = qry.ifi.Index
+    }
+
+    out, ok := s.outgoing[key]
+    if ok != true {
+        out = &outgoing{ qry: qry, deadline: now.Add(delay) }
+
+        s.outgoing[key] = out
+    }
+
+    for _, rr := range an {
+        if HasRecord(out.answers, rr) != true {
+            out.answers = append(out.answers, rr)
+        }
+    }
+
+    for _, rr := range ar {
+        if HasRecord(out.additional, rr) != true {
+            out.additional = append(out.additional, rr)
+        }
+    }
+
+    if delay > 0 {
+        return
+    }
+
+    delete(s.outgoing, key)
+
+    s.SendMulticast(out)
+}
+
+func (s *Server) SendMulticast(out *outgoing) {
+    rsp := new(Message)
+
+    rsp.Header.Flags |= FlagQR
+    rsp.Header.Flags |= FlagAA
+
+    for _, rr := range out.answers {
+        rsp.AppendAN(rr)
+    }
+
+    for _, rr := range out.additional {
+        /* no need to repeat what's already in the answers */
+        if HasRecord(out.answers, rr) != true {
+            rsp.AppendAR(rr)
+        }
+    }
+
+    if s.SendResponse(out.qry, out.qry.conn.Group, rsp) {
+        var rrs []*Record
+
+        rrs = append(rrs, rsp.Answer...)
+        rrs = append(rrs, rsp.Additional...)
+
+        s.history.Add(out.qry.conn, out.qry.ifi, rrs, time.Now())
+    }
+}
+
+func (s *Server) SendResponse(qry *query, addr *net.UDPAddr, rsp *Message) bool {
+    ifi := qry.ifi
+
+    /* the kernel knows better where looped back packets go */
+    if qry.loopback {
+        ifi = nil
+    }
+
+    var err error
+
+    if addr.Port != qry.conn.Group.Port {
+        err = WriteTruncated(qry.conn, ifi, addr, rsp, LegacySize(qry.msg))
+    } else {
+        err = WriteResponse(qry.conn, ifi, addr, rsp)
+    }
+
+    if err != nil {
+        if s.Silent != true {
+            log.Println("Error sending response: ", err)
+        }
+
+        return false
+    }
+
+    return true
+}
+
+/* Shared records, as opposed to unique ones, may be answered by more than a
+ * single responder and are sent without the cache-flush bit. */
+func HasShared(rrs []*Record) bool {
+    for _, rr := range rrs {
+        if rr.Class & ClassCacheFlush == 0 {
+            return true
+        }
+    }
+
+    return false
+}
+
+/* Probes carry the proposed records in the authority section. */
+func IsProbe(req *Message) bool {
+    return len(req.Question) > 0 && len(req.Authority) > 0
+}
+
+/* Returns true if the record was only asked for by QU questions. */
+func IsUnicastAnswer(req *Message, rr *Record) bool {
+    asked := false
+
+    for _, q := range req.Question {
+        if q.Matches(rr) != true {
+            continue
+        }
+
+        if q.Class & ClassUnicast == 0 {
+            return false
+        }
+
+        asked = true
+    }
+
+    return asked
+}
+
+func SuppressKnown(rrs []*Record, known []*Record) []*Record {
+    var keep []*Record
+
+    for _, rr := range rrs {
+        if IsKnownAnswer(rr, known) != true {
+            keep = append(keep, rr)
+        }
+    }
+
+    return keep
+}
+
+func IsKnownAnswer(rr *Record, known []*Record) bool {
+    for _, k := range known {
+        if IsSameName(k.Name, string(rr.Name)) != true ||
+           k.Type != rr.Type ||
+           k.Class &^ ClassCacheFlush != rr.Class &^ ClassCacheFlush {
+            continue
+        }
+
+        /* the querier's copy must have at least half its lifetime left */
+        if k.TTL < rr.TTL / 2 {
+            continue
+        }
+
+        if IsSameRData(k, rr) {
+            return true
+        }
+    }
+
+    return false
+}
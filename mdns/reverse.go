@@ -0,0 +1,77 @@
+/*
+ * Minimal multicast DNS server.
+ *
+ * Copyright (c) 2014, Alessandro Ghedini
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are
+ * met:
+ *
+ *     * Redistributions of source code must retain the above copyright
+ *       notice, this list of conditions and the following disclaimer.
+ *
+ *     * Redistributions in binary form must reproduce the above copyright
+ *       notice, this list of conditions and the following disclaimer in the
+ *       documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS
+ * IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO,
+ * THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR
+ * PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR
+ * CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL,
+ * EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+ * PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+ * PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF
+ * LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING
+ * NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+ * SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package mdns
+
+import "fmt"
+import "net"
+import "strings"
+
+func ReverseName(ip net.IP) string {
+    if ip4 := ip.To4(); ip4 != nil {
+        return fmt.Sprintf("%d.%d.%d.%d.in-addr.arpa.",
+                           ip4[3], ip4[2], ip4[1], ip4[0])
+    }
+
+    ip6 := ip.To16()
+    if ip6 == nil {
+        return ""
+    }
+
+    var nibbles []string
+
+    for i := len(ip6) - 1; i >= 0; i-- {
+        nibbles = append(nibbles, fmt.Sprintf("%x.%x", ip6[i] & 0xF, ip6[i] >> 4))
+    }
+
+    return strings.Join(nibbles, ".") + ".ip6.arpa."
+}
+
+func ReverseRecords(name []byte, localname string, ifi *net.Interface) []*Record {
+    var rrs []*Record
+
+    if ifi == nil {
+        return nil
+    }
+
+    addrs, err := ifi.Addrs()
+    if err != nil {
+        return nil
+    }
+
+    for _, a := range addrs {
+        if IsSameName(name, ReverseName(a.(*net.IPNet).IP)) {
+            rrs = append(rrs, NewAN(name, ClassInet | ClassCacheFlush,
+                                    hostTTL, NewPTR(localname)))
+        }
+    }
+
+    return rrs
+}
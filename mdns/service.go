@@ -0,0 +1,316 @@
+/*
+ * Minimal multicast DNS server.
+ *
+ * Copyright (c) 2014, Alessandro Ghedini
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are
+ * met:
+ *
+ *     * Redistributions of source code must retain the above copyright
+ *       notice, this list of conditions and the following disclaimer.
+ *
+ *     * Redistributions in binary form must reproduce the above copyright
+ *       notice, this list of conditions and the following disclaimer in the
+ *       documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS
+ * IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO,
+ * THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR
+ * PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR
+ * CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL,
+ * EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+ * PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+ * PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF
+ * LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING
+ * NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+ * SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package mdns
+
+import "fmt"
+import "strings"
+import "sync"
+
+const servicesName = "_services._dns-sd._udp."
+
+const hostTTL    = 120
+const serviceTTL = 4500
+
+type Service struct {
+    Instance string
+    Service  string
+    Domain   string
+    Host     string
+    Port     uint16
+    Text     []string
+    Subtypes []string
+}
+
+func (s *Service) domain() string {
+    if s.Domain == "" {
+        return "local."
+    }
+
+    domain := strings.TrimPrefix(s.Domain, ".")
+
+    return string(CanonicalName([]byte(domain)))
+}
+
+func (s *Service) ServiceName() string {
+    return s.Service + "." + s.domain()
+}
+
+func (s *Service) InstanceName() string {
+    return string(EscapeLabel([]byte(s.Instance))) + "." + s.ServiceName()
+}
+
+func (s *Service) SubtypeName(subtype string) string {
+    return string(EscapeLabel([]byte(subtype))) + "._sub." + s.ServiceName()
+}
+
+func (s *Service) Target(localname string) string {
+    if s.Host == "" {
+        return localname
+    }
+
+    return s.Host
+}
+
+type Registry struct {
+    mutex        sync.Mutex
+    services     []*Service
+    registered   []func(*Service)
+    deregistered []func(*Service)
+}
+
+func NewRegistry() *Registry {
+    return new(Registry)
+}
+
+func (r *Registry) Register(s *Service) error {
+    if s.Instance == "" {
+        return fmt.Errorf("Missing instance name")
+    }
+
+    if len(s.Instance) > maxLabelLen {
+        return fmt.Errorf("Instance name too long: %d", len(s.Instance))
+    }
+
+    if strings.HasPrefix(s.Service, "_") != true ||
+       (strings.HasSuffix(s.Service, "._tcp") != true &&
+        strings.HasSuffix(s.Service, "._udp") != true) {
+        return fmt.Errorf("Invalid service type '%s'", s.Service)
+    }
+
+    if s.Port == 0 {
+        return fmt.Errorf("Missing port")
+    }
+
+    err := ValidateTXT(s.Text)
+    if err != nil {
+        return err
+    }
+
+    r.mutex.Lock()
+
+    for _, old := range r.services {
+        if strings.EqualFold(old.InstanceName(), s.InstanceName()) {
+            r.mutex.Unlock()
+            return fmt.Errorf("Service '%s' already registered",
+                              s.InstanceName())
+        }
+    }
+
+    r.services = append(r.services, s)
+
+    watchers := r.registered
+
+    r.mutex.Unlock()
+
+    for _, fn := range watchers {
+        fn(s)
+    }
+
+    return nil
+}
+
+func (r *Registry) Deregister(s *Service) error {
+    var removed *Service
+
+    r.mutex.Lock()
+
+    for i, old := range r.services {
+        if strings.EqualFold(old.InstanceName(), s.InstanceName()) {
+            r.services = append(r.services[:i], r.services[i + 1:]...)
+            removed    = old
+            break
+        }
+    }
+
+    watchers := r.deregistered
+
+    r.mutex.Unlock()
+
+    if removed == nil {
+        return fmt.Errorf("Service '%s' not registered", s.InstanceName())
+    }
+
+    for _, fn := range watchers {
+        fn(removed)
+    }
+
+    return nil
+}
+
+func (r *Registry) NotifyRegister(fn func(*Service)) {
+    r.mutex.Lock()
+    defer r.mutex.Unlock()
+
+    r.registered = append(r.registered, fn)
+}
+
+func (r *Registry) NotifyDeregister(fn func(*Service)) {
+    r.mutex.Lock()
+    defer r.mutex.Unlock()
+
+    r.deregistered = append(r.deregistered, fn)
+}
+
+func (r *Registry) HasService(name string) bool {
+    for _, s := range r.Services() {
+        if strings.EqualFold(s.ServiceName(), name) {
+            return true
+        }
+    }
+
+    return false
+}
+
+func (r *Registry) Services() []*Service {
+    r.mutex.Lock()
+    defer r.mutex.Unlock()
+
+    return append([]*Service(nil), r.services...)
+}
+
+func (r *Registry) Answer(q *Question, localname string) ([]*Record, []*Record) {
+    var an, ar []*Record
+
+    name := string(q.Name)
+
+    isType := func(t Type) bool {
+        return q.Type == t || q.Type == TypeAny
+    }
+
+    seen := make(map[string]bool)
+
+    for _, s := range r.Services() {
+        switch {
+        case strings.EqualFold(name, servicesName + s.domain()):
+            if isType(TypePTR) != true || seen[s.ServiceName()] {
+                continue
+            }
+
+            seen[s.ServiceName()] = true
+
+            an = append(an, NewAN(q.Name, ClassInet, serviceTTL,
+                                  NewPTR(s.ServiceName())))
+
+        case strings.EqualFold(name, s.ServiceName()) ||
+             s.hasSubtype(name):
+            if isType(TypePTR) != true {
+                continue
+            }
+
+            an = append(an, NewAN(q.Name, ClassInet, serviceTTL,
+                                  NewPTR(s.InstanceName())))
+
+            ar = append(ar, s.records(localname)...)
+
+        case strings.EqualFold(name, s.InstanceName()):
+            matched := false
+
+            for _, rr := range s.records(localname) {
+                if isType(rr.Type) {
+                    an = append(an, rr)
+                    matched = true
+                } else {
+                    ar = append(ar, rr)
+                }
+            }
+
+            /* the instance only has SRV and TXT records */
+            if matched != true {
+                nsec := NewNSEC(s.InstanceName(), []Type{ TypeTXT, TypeSRV })
+
+                an = append(an, NewAN(q.Name, ClassInet | ClassCacheFlush,
+                                      hostTTL, nsec))
+            }
+        }
+    }
+
+    return an, ar
+}
+
+func (r *Registry) Records(localname string) []*Record {
+    var rrs []*Record
+
+    seen := make(map[string]bool)
+
+    for _, s := range r.Services() {
+        if seen[s.ServiceName()] != true {
+            seen[s.ServiceName()] = true
+
+            rrs = append(rrs, s.MetaRecord())
+        }
+
+        rrs = append(rrs, s.Records(localname)...)
+    }
+
+    return rrs
+}
+
+func (s *Service) MetaRecord() *Record {
+    meta := []byte(servicesName + s.domain())
+
+    return NewAN(meta, ClassInet, serviceTTL, NewPTR(s.ServiceName()))
+}
+
+func (s *Service) Records(localname string) []*Record {
+    var rrs []*Record
+
+    rrs = append(rrs, NewAN([]byte(s.ServiceName()), ClassInet,
+                            serviceTTL, NewPTR(s.InstanceName())))
+
+    for _, sub := range s.Subtypes {
+        rrs = append(rrs, NewAN([]byte(s.SubtypeName(sub)), ClassInet,
+                                serviceTTL, NewPTR(s.InstanceName())))
+    }
+
+    return append(rrs, s.records(localname)...)
+}
+
+func (s *Service) hasSubtype(name string) bool {
+    for _, sub := range s.Subtypes {
+        if strings.EqualFold(name, s.SubtypeName(sub)) {
+            return true
+        }
+    }
+
+    return false
+}
+
+func (s *Service) records(localname string) []*Record {
+    name := []byte(s.InstanceName())
+
+    srv := NewSRV(0, 0, s.Port, s.Target(localname))
+    txt := NewTXT(s.Text)
+
+    return []*Record{
+        NewAN(name, ClassInet | ClassCacheFlush, hostTTL, srv),
+        NewAN(name, ClassInet | ClassCacheFlush, serviceTTL, txt),
+    }
+}
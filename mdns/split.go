@@ -0,0 +1,287 @@
+/*
+ * Minimal multicast DNS server.
+ *
+ * Copyright (c) 2014, Alessandro Ghedini
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are
+ * met:
+ *
+ *     * Redistributions of source code must retain the above copyright
+ *       notice, this list of conditions and the following disclaimer.
+ *
+ *     * Redistributions in binary form must reproduce the above copyright
+ *       notice, this list of conditions and the following disclaimer in the
+ *       documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS
+ * IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO,
+ * THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR
+ * PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR
+ * CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL,
+ * EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+ * PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+ * PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF
+ * LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING
+ * NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+ * SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package mdns
+
+import "net"
+
+/* the largest message we send or expect to receive, RFC 6762 §17 */
+const maxPacketSize = 9000
+
+/* legacy resolvers don't expect more than plain DNS over UDP allows */
+const legacySize = 512
+
+const defaultMTU = 1500
+
+const ipv4Overhead = 20 + 8
+const ipv6Overhead = 40 + 8
+
+/* Returns the largest message that fits in a single packet sent on the
+ * given interface. */
+func MaxMessageSize(c *Conn, ifi *net.Interface) int {
+    mtu := defaultMTU
+
+    if ifi != nil && ifi.MTU > 0 {
+        mtu = ifi.MTU
+    }
+
+    if mtu > maxPacketSize {
+        mtu = maxPacketSize
+    }
+
+    if c.IsIPv6() {
+        return mtu - ipv6Overhead
+    }
+
+    return mtu - ipv4Overhead
+}
+
+/* Groups the unique records with the same name, type and class, preserving
+ * the order in which they first appear. Shared records, like the PTRs of a
+ * service type, each make a set of their own, since a querier can't flush
+ * them and there can be any number of them. */
+func RecordSets(rrs []*Record) [][]*Record {
+    var sets [][]*Record
+
+    index := make(map[cacheKey]int)
+
+    for _, rr := range rrs {
+        if rr.Class & ClassCacheFlush == 0 {
+            sets = append(sets, []*Record{ rr })
+            continue
+        }
+
+        key := MakeCacheKey(rr.Name, rr.Type, rr.Class)
+
+        i, ok := index[key]
+        if ok != true {
+            i = len(sets)
+
+            index[key] = i
+            sets = append(sets, nil)
+        }
+
+        sets[i] = append(sets[i], rr)
+    }
+
+    return sets
+}
+
+func NewPart(msg *Message, an, ns, ar []*Record) *Message {
+    part := new(Message)
+
+    part.Header.Id    = msg.Header.Id
+    part.Header.Flags = msg.Header.Flags
+
+    for _, q := range msg.Question {
+        part.AppendQD(q)
+    }
+
+    for _, rr := range an {
+        part.AppendAN(rr)
+    }
+
+    for _, rr := range ns {
+        part.AppendNS(rr)
+    }
+
+    for _, rr := range ar {
+        part.AppendAR(rr)
+    }
+
+    return part
+}
+
+func Fits(msg *Message, size int) (bool, error) {
+    buf := GetBuffer()
+    defer PutBuffer(buf)
+
+    pkt, err := PackBuffer(*buf, msg)
+    if err != nil {
+        return false, err
+    }
+
+    *buf = pkt
+
+    return len(pkt) <= size, nil
+}
+
+/* Splits the message in as many messages as needed for each of them to fit
+ * in size bytes, without ever splitting a unique record set. Additional
+ * records that don't fit in the last message are left out. */
+func SplitMessage(msg *Message, size int) ([]*Message, error) {
+    var parts []*Message
+
+    var an, ns, ar []*Record
+
+    /* answer and authority sets go in order, with the authority of the
+     * last message following its answers */
+    var sets [][]*Record
+    var authority []bool
+
+    for _, set := range RecordSets(msg.Answer) {
+        sets      = append(sets, set)
+        authority = append(authority, false)
+    }
+
+    for _, set := range RecordSets(msg.Authority) {
+        sets      = append(sets, set)
+        authority = append(authority, true)
+    }
+
+    for i, set := range sets {
+        try_an, try_ns := an, ns
+
+        if authority[i] {
+            try_ns = append(append([]*Record{}, ns...), set...)
+        } else {
+            try_an = append(append([]*Record{}, an...), set...)
+        }
+
+        ok, err := Fits(NewPart(msg, try_an, try_ns, nil), size)
+        if err != nil {
+            return nil, err
+        }
+
+        /* a set too big on its own is sent anyway, and left to IP
+         * fragmentation */
+        if ok != true && len(an) + len(ns) > 0 {
+            parts = append(parts, NewPart(msg, an, ns, nil))
+
+            an, ns = nil, nil
+
+            if authority[i] {
+                ns = set
+            } else {
+                an = set
+            }
+
+            continue
+        }
+
+        an, ns = try_an, try_ns
+    }
+
+    for _, set := range RecordSets(msg.Additional) {
+        try_ar := append(append([]*Record{}, ar...), set...)
+
+        ok, err := Fits(NewPart(msg, an, ns, try_ar), size)
+        if err != nil {
+            return nil, err
+        }
+
+        if ok {
+            ar = try_ar
+        }
+    }
+
+    parts = append(parts, NewPart(msg, an, ns, ar))
+
+    return parts, nil
+}
+
+/* Returns as much of the message as fits in size bytes, with the TC flag
+ * set if any answer or authority record had to be left out. */
+func TruncateMessage(msg *Message, size int) (*Message, error) {
+    var additional []*Record
+
+    /* the OPT record must never be left out */
+    opt := FindEDNS(msg)
+
+    if opt != nil {
+        for _, rr := range msg.Additional {
+            if rr != opt {
+                additional = append(additional, rr)
+            }
+        }
+
+        msg   = NewPart(msg, msg.Answer, msg.Authority, additional)
+        size -= 1 + 2 + 2 + 4 + 2 + int(opt.RData.Len())
+    }
+
+    parts, err := SplitMessage(msg, size)
+    if err != nil {
+        return nil, err
+    }
+
+    rsp := parts[0]
+
+    ok, err := Fits(rsp, size)
+    if err != nil {
+        return nil, err
+    }
+
+    /* a set too big on its own is better sent in part than not at all */
+    if ok != true {
+        rsp, err = FillMessage(msg, rsp.Answer, rsp.Authority, size)
+        if err != nil {
+            return nil, err
+        }
+    }
+
+    if len(parts) > 1 || ok != true {
+        rsp.Header.Flags |= FlagTC
+    }
+
+    if opt != nil {
+        rsp.AppendAR(opt)
+    }
+
+    return rsp, nil
+}
+
+/* Returns a message with as many of the given records as fit in size bytes,
+ * in order. */
+func FillMessage(msg *Message, an, ns []*Record, size int) (*Message, error) {
+    var fill_an, fill_ns []*Record
+
+    for i, rr := range append(append([]*Record{}, an...), ns...) {
+        try_an, try_ns := fill_an, fill_ns
+
+        if i < len(an) {
+            try_an = append(append([]*Record{}, fill_an...), rr)
+        } else {
+            try_ns = append(append([]*Record{}, fill_ns...), rr)
+        }
+
+        ok, err := Fits(NewPart(msg, try_an, try_ns, nil), size)
+        if err != nil {
+            return nil, err
+        }
+
+        if ok != true {
+            break
+        }
+
+        fill_an, fill_ns = try_an, try_ns
+    }
+
+    return NewPart(msg, fill_an, fill_ns, nil), nil
+}
@@ -0,0 +1,151 @@
+/*
+ * Minimal multicast DNS server.
+ *
+ * Copyright (c) 2014, Alessandro Ghedini
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are
+ * met:
+ *
+ *     * Redistributions of source code must retain the above copyright
+ *       notice, this list of conditions and the following disclaimer.
+ *
+ *     * Redistributions in binary form must reproduce the above copyright
+ *       notice, this list of conditions and the following disclaimer in the
+ *       documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS
+ * IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO,
+ * THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR
+ * PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR
+ * CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL,
+ * EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+ * PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+ * PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF
+ * LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING
+ * NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+ * SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package mdns
+
+import "fmt"
+import "net"
+import "testing"
+
+func TestTruncateMessageEDNS(t *testing.T) {
+    msg := new(Message)
+
+    msg.Header.Flags |= FlagQR
+
+    msg.AppendAN(NewAN([]byte("host.local."), ClassInet, 120, NewA(net.IPv4(192, 0, 2, 1))))
+    msg.AppendAR(NewEDNS(1232, 0, false))
+
+    pkt, err := Pack(msg)
+    if err != nil {
+        t.Fatalf("Could not pack message: %s", err)
+    }
+
+    msg, err = Unpack(pkt)
+    if err != nil {
+        t.Fatalf("Could not unpack message: %s", err)
+    }
+
+    opt := FindEDNS(msg)
+    if opt == nil || opt.RData == nil {
+        t.Fatalf("OPT record without options lost its rdata")
+    }
+
+    rsp, err := TruncateMessage(msg, legacySize)
+    if err != nil {
+        t.Fatalf("Could not truncate message: %s", err)
+    }
+
+    if rsp.Header.ANCount != 1 || FindEDNS(rsp) == nil {
+        t.Fatalf("Unexpected truncated message:\n%s", rsp)
+    }
+}
+
+func TestSplitResponse(t *testing.T) {
+    services := NewRegistry()
+
+    for i := 0; i < 60; i++ {
+        err := services.Register(&Service{
+            Instance: fmt.Sprintf("Service %d", i),
+            Service:  "_http._tcp",
+            Port:     80,
+            Text:     []string{ "path=/" },
+        })
+        if err != nil {
+            t.Fatalf("Could not register service: %s", err)
+        }
+    }
+
+    s := &Server{ Name: "testhost.local.", Services: services }
+
+    req := new(Message)
+
+    req.AppendQD(NewQD([]byte("_http._tcp.local."), TypePTR, ClassInet))
+    req.AppendQD(NewQD([]byte("testhost.local."), TypeAny, ClassInet))
+
+    qry := &query{
+        msg:    req,
+        local4: &net.IPNet{ IP: net.IPv4(192, 0, 2, 1) },
+        local6: &net.IPNet{ IP: net.ParseIP("fe80::1") },
+        client: &net.UDPAddr{ IP: net.IPv4(192, 0, 2, 2), Port: 5353 },
+    }
+
+    rsp := s.MakeResponse(qry)
+
+    for _, rr := range append(rsp.Answer, rsp.Additional...) {
+        if rr.Type != TypePTR && rr.Class & ClassCacheFlush == 0 {
+            t.Errorf("Unique record without cache-flush bit: %s %s", rr.Name, rr.Type)
+        }
+    }
+
+    size := defaultMTU - ipv4Overhead
+
+    parts, err := SplitMessage(rsp, size)
+    if err != nil {
+        t.Fatalf("Could not split message: %s", err)
+    }
+
+    if len(parts) < 2 {
+        t.Fatalf("Expected several parts, got %d", len(parts))
+    }
+
+    answers := 0
+    sets    := make(map[cacheKey]int)
+
+    for i, part := range parts {
+        pkt, err := Pack(part)
+        if err != nil {
+            t.Fatalf("Could not pack part %d: %s", i, err)
+        }
+
+        if len(pkt) > size {
+            t.Errorf("Part %d too big: %d bytes", i, len(pkt))
+        }
+
+        answers += len(part.Answer)
+
+        for _, rr := range part.Answer {
+            if rr.Class & ClassCacheFlush == 0 {
+                continue
+            }
+
+            key := MakeCacheKey(rr.Name, rr.Type, rr.Class)
+
+            if j, ok := sets[key]; ok && j != i {
+                t.Errorf("Record set split across parts: %s %s", rr.Name, rr.Type)
+            }
+
+            sets[key] = i
+        }
+    }
+
+    if answers != len(rsp.Answer) {
+        t.Errorf("Expected %d answers, got %d", len(rsp.Answer), answers)
+    }
+}
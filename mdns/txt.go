@@ -0,0 +1,123 @@
+/*
+ * Minimal multicast DNS server.
+ *
+ * Copyright (c) 2014, Alessandro Ghedini
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are
+ * met:
+ *
+ *     * Redistributions of source code must retain the above copyright
+ *       notice, this list of conditions and the following disclaimer.
+ *
+ *     * Redistributions in binary form must reproduce the above copyright
+ *       notice, this list of conditions and the following disclaimer in the
+ *       documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS
+ * IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO,
+ * THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR
+ * PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR
+ * CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL,
+ * EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+ * PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+ * PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF
+ * LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING
+ * NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+ * SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package mdns
+
+import "fmt"
+import "strings"
+
+/* a TXT record can't be bigger than its rdata, RFC 6763 §6.2 */
+const maxTXTLen = 65535
+
+/* Value of a DNS-SD attribute, which is missing for boolean attributes,
+ * and may otherwise be empty or hold arbitrary binary data. */
+type TXTValue struct {
+    Value    string
+    HasValue bool
+}
+
+/* Splits a DNS-SD attribute at the first '=', RFC 6763 §6.3-6.5. */
+func ParseTXTAttr(s string) (string, TXTValue) {
+    i := strings.IndexByte(s, '=')
+    if i < 0 {
+        return s, TXTValue{}
+    }
+
+    return s[:i], TXTValue{ Value: s[i + 1:], HasValue: true }
+}
+
+/* Returns the attributes of the record keyed by their lowercase key. Strings
+ * without a key are ignored, and only the first occurrence of a key counts,
+ * RFC 6763 §6.4. */
+func (rr *TXT) Attributes() map[string]TXTValue {
+    attrs := make(map[string]TXTValue)
+
+    for _, s := range rr.TXT {
+        key, value := ParseTXTAttr(s)
+        if key == "" {
+            continue
+        }
+
+        key = strings.ToLower(key)
+
+        if _, ok := attrs[key]; ok {
+            continue
+        }
+
+        attrs[key] = value
+    }
+
+    return attrs
+}
+
+/* Keys are case insensitive. */
+func (rr *TXT) Lookup(key string) (TXTValue, bool) {
+    value, ok := rr.Attributes()[strings.ToLower(key)]
+
+    return value, ok
+}
+
+/* Checks that the strings make for a valid DNS-SD TXT record. */
+func ValidateTXT(txt []string) error {
+    total := 0
+
+    seen := make(map[string]bool)
+
+    for _, s := range txt {
+        if len(s) > 255 {
+            return fmt.Errorf("TXT string too long: %d", len(s))
+        }
+
+        total += 1 + len(s)
+
+        key, _ := ParseTXTAttr(s)
+        if key == "" {
+            return fmt.Errorf("Missing key in TXT string '%s'", s)
+        }
+
+        for _, c := range []byte(key) {
+            if c < 0x20 || c > 0x7E {
+                return fmt.Errorf("Invalid TXT key '%s'", key)
+            }
+        }
+
+        if seen[strings.ToLower(key)] {
+            return fmt.Errorf("Duplicate TXT key '%s'", key)
+        }
+
+        seen[strings.ToLower(key)] = true
+    }
+
+    if total > maxTXTLen {
+        return fmt.Errorf("TXT record too long: %d", total)
+    }
+
+    return nil
+}
@@ -31,6 +31,7 @@
 package mdns
 
 import "bytes"
+import "encoding/binary"
 import "fmt"
 import "net"
 import "strings"
@@ -100,7 +101,7 @@ func (t Flags) String() string {
     }
 
     if t & FlagTC != 0 {
-        s = append(s, "rc")
+        s = append(s, "tc")
     }
 
     if t & FlagRD != 0 {
@@ -134,6 +135,7 @@ const (
     TypeAAAA       = 28
     TypeSRV        = 33
     TypeOPT        = 41
+    TypeNSEC       = 47
     TypeAny        = 255
 )
 
@@ -166,6 +168,9 @@ func (t Type) MakeRR() RData {
     case TypeOPT:
         return new(OPT)
 
+    case TypeNSEC:
+        return new(NSEC)
+
     case TypeAny:
         return nil
 
@@ -203,11 +208,14 @@ func (t Type) String() string {
     case TypeOPT:
         return "OPT"
 
+    case TypeNSEC:
+        return "NSEC"
+
     case TypeAny:
         return "ANY"
 
     default:
-        return "Unknown"
+        return fmt.Sprintf("TYPE%d", uint16(t))
     }
 }
 
@@ -218,6 +226,7 @@ const (
     ClassNone          = 254
     ClassAny           = 255
     ClassUnicast       = 1 << 15
+    ClassCacheFlush    = 1 << 15
 )
 
 func (c Class) String() string {
@@ -232,7 +241,7 @@ func (c Class) String() string {
         return "ANY"
 
     default:
-        return "Unknown"
+        return fmt.Sprintf("CLASS%d", uint16(c))
     }
 }
 
@@ -254,12 +263,29 @@ func (msg *Message) AppendAN(an *Record) {
     msg.Header.ANCount++
 }
 
+func (msg *Message) AppendNS(ns *Record) {
+    msg.Authority = append(msg.Authority, ns)
+    msg.Header.NSCount++
+}
+
+func (msg *Message) AppendAR(ar *Record) {
+    msg.Additional = append(msg.Additional, ar)
+    msg.Header.ARCount++
+}
+
 func (m *Message) String() string {
     b := new(bytes.Buffer)
 
+    status := m.Header.Flags.RCodeString()
+
+    if opt := FindEDNS(m); opt != nil &&
+       EDNSExtendedRCode(opt) == ExtRCodeBadVers {
+        status = "BADVERS"
+    }
+
     fmt.Fprintf(b, ";;")
     fmt.Fprintf(b, " opcode: %d,", 255)
-    fmt.Fprintf(b, " status: %s,", m.Header.Flags.RCodeString())
+    fmt.Fprintf(b, " status: %s,", status)
     fmt.Fprintf(b, " id: %d", m.Header.Id)
     fmt.Fprintf(b, "\n")
 
@@ -268,9 +294,22 @@ func (m *Message) String() string {
     fmt.Fprintf(b, " QUERY: %d,", m.Header.QDCount)
     fmt.Fprintf(b, " ANSWER: %d,", m.Header.ANCount)
     fmt.Fprintf(b, " AUTHORITY: %d,", m.Header.NSCount)
-    fmt.Fprintf(b, " ADDITIONAL: %d", m.Header.NSCount)
+    fmt.Fprintf(b, " ADDITIONAL: %d", m.Header.ARCount)
     fmt.Fprintf(b, "\n\n")
 
+    if opt := FindEDNS(m); opt != nil {
+        var flags string
+
+        if EDNSDo(opt) {
+            flags = "do"
+        }
+
+        fmt.Fprintf(b, ";; OPT PSEUDOSECTION:\n")
+        fmt.Fprintf(b, "; EDNS: version: %d, flags: %s; udp: %d\n",
+                    EDNSVersion(opt), flags, EDNSPayloadSize(opt))
+        fmt.Fprintln(b, "")
+    }
+
     if m.Header.QDCount > 0 {
         fmt.Fprintf(b, ";; QUESTION SECTION:\n")
     }
@@ -298,9 +337,66 @@ func (m *Message) String() string {
         fmt.Fprintln(b, "")
     }
 
+    if m.Header.NSCount > 0 {
+        fmt.Fprintf(b, ";; AUTHORITY SECTION:\n")
+    }
+
+    for _, ns := range m.Authority {
+        fmt.Fprintf(b, ";%s\t\t%d\t%s\t%s\t%s\n",
+                    string(ns.Name), ns.TTL, ns.Class,
+                ns.Type, ns.RData)
+    }
+
+    if m.Header.NSCount > 0 {
+        fmt.Fprintln(b, "")
+    }
+
+    var additional []*Record
+
+    for _, ar := range m.Additional {
+        if ar.Type != TypeOPT {
+            additional = append(additional, ar)
+        }
+    }
+
+    if len(additional) > 0 {
+        fmt.Fprintf(b, ";; ADDITIONAL SECTION:\n")
+    }
+
+    for _, ar := range additional {
+        fmt.Fprintf(b, ";%s\t\t%d\t%s\t%s\t%s\n",
+                    string(ar.Name), ar.TTL, ar.Class,
+                ar.Type, ar.RData)
+    }
+
+    if len(additional) > 0 {
+        fmt.Fprintln(b, "")
+    }
+
     return b.String()
 }
 
+/* Names must be canonical, as returned by UnpackName or CanonicalName. */
+func IsSameName(name []byte, other string) bool {
+    return strings.EqualFold(string(name), other)
+}
+
+func IsSameRecord(a, b *Record) bool {
+    return IsSameName(a.Name, string(b.Name)) &&
+           a.Class &^ ClassCacheFlush == b.Class &^ ClassCacheFlush &&
+           IsSameRData(a, b)
+}
+
+func HasRecord(rrs []*Record, rr *Record) bool {
+    for _, other := range rrs {
+        if IsSameRecord(other, rr) {
+            return true
+        }
+    }
+
+    return false
+}
+
 type Header struct {
     Id    uint16
     Flags Flags
@@ -311,27 +407,200 @@ type Header struct {
     ARCount uint16
 }
 
+func (h *Header) Pack(b []byte) []byte {
+    b = PackUint16(b, h.Id)
+    b = PackUint16(b, uint16(h.Flags))
+    b = PackUint16(b, h.QDCount)
+    b = PackUint16(b, h.ANCount)
+    b = PackUint16(b, h.NSCount)
+    b = PackUint16(b, h.ARCount)
+
+    return b
+}
+
+func (h *Header) Unpack(msg []byte, off int) (int, error) {
+    var fields [6]uint16
+
+    for i := range fields {
+        v, n, err := UnpackUint16(msg, off)
+        if err != nil {
+            return off, fmt.Errorf("read: %w", err)
+        }
+
+        fields[i] = v
+        off       = n
+    }
+
+    h.Id      = fields[0]
+    h.Flags   = Flags(fields[1])
+    h.QDCount = fields[2]
+    h.ANCount = fields[3]
+    h.NSCount = fields[4]
+    h.ARCount = fields[5]
+
+    return off, nil
+}
+
 type Question struct {
-    Name  []byte `mdns:"name"`
+    Name  []byte
     Type  Type
     Class Class
 }
 
+func (q *Question) Pack(b []byte, names map[string]int) ([]byte, error) {
+    b, err := PackName(b, names, q.Name)
+    if err != nil {
+        return nil, fmt.Errorf("name: %s", err)
+    }
+
+    b = PackUint16(b, uint16(q.Type))
+    b = PackUint16(b, uint16(q.Class))
+
+    return b, nil
+}
+
+func (q *Question) Unpack(msg []byte, off int) (int, error) {
+    name, off, err := UnpackName(msg, off)
+    if err != nil {
+        return off, fmt.Errorf("name: %w", err)
+    }
+
+    t, off, err := UnpackUint16(msg, off)
+    if err != nil {
+        return off, fmt.Errorf("read: %w", err)
+    }
+
+    class, off, err := UnpackUint16(msg, off)
+    if err != nil {
+        return off, fmt.Errorf("read: %w", err)
+    }
+
+    q.Name  = name
+    q.Type  = Type(t)
+    q.Class = Class(class)
+
+    return off, nil
+}
+
 func NewQD(name []byte, t Type, class Class) *Question {
     return &Question{
-        Name:  name,
+        Name:  CanonicalName(name),
         Type:  t,
         Class: class,
     }
 }
 
+func (q *Question) Matches(rr *Record) bool {
+    if IsSameName(rr.Name, string(q.Name)) != true {
+        return false
+    }
+
+    return q.Type == TypeAny || q.Type == rr.Type
+}
+
 type Record struct {
-    Name  []byte `mdns:"name"`
+    Name  []byte
     Type  Type
     Class Class
     TTL   uint32
     RDLen uint16
-    RData RData `mdns:"rdata"`
+    RData RData
+}
+
+func (rr *Record) Pack(b []byte, names map[string]int) ([]byte, error) {
+    b, err := PackName(b, names, rr.Name)
+    if err != nil {
+        return nil, fmt.Errorf("name: %s", err)
+    }
+
+    b = PackUint16(b, uint16(rr.Type))
+    b = PackUint16(b, uint16(rr.Class))
+    b = PackUint32(b, rr.TTL)
+    b = PackUint16(b, 0)
+
+    start := len(b)
+
+    if rr.RData != nil {
+        b, err = rr.RData.Pack(b, names)
+        if err != nil {
+            return nil, fmt.Errorf("rdata: %s", err)
+        }
+    }
+
+    /* now that the actual (possibly compressed) length is known, patch
+     * RDLen which was written just before the rdata */
+    if len(b) - start > 0xFFFF {
+        return nil, fmt.Errorf("rdata too long: %d", len(b) - start)
+    }
+
+    rr.RDLen = uint16(len(b) - start)
+
+    binary.BigEndian.PutUint16(b[start - 2:start], rr.RDLen)
+
+    return b, nil
+}
+
+func (rr *Record) Unpack(msg []byte, off int) (int, error) {
+    name, off, err := UnpackName(msg, off)
+    if err != nil {
+        return off, fmt.Errorf("name: %w", err)
+    }
+
+    t, off, err := UnpackUint16(msg, off)
+    if err != nil {
+        return off, fmt.Errorf("read: %w", err)
+    }
+
+    class, off, err := UnpackUint16(msg, off)
+    if err != nil {
+        return off, fmt.Errorf("read: %w", err)
+    }
+
+    ttl, off, err := UnpackUint32(msg, off)
+    if err != nil {
+        return off, fmt.Errorf("read: %w", err)
+    }
+
+    rdlen, off, err := UnpackUint16(msg, off)
+    if err != nil {
+        return off, fmt.Errorf("read: %w", err)
+    }
+
+    rr.Name  = name
+    rr.Type  = Type(t)
+    rr.Class = Class(class)
+    rr.TTL   = ttl
+    rr.RDLen = rdlen
+
+    end := off + int(rdlen)
+    if end > len(msg) {
+        return off, fmt.Errorf("read: %w", ErrTruncated)
+    }
+
+    rdata := rr.Type.MakeRR()
+
+    /* keep whatever we don't know about as opaque data, an OPT without
+     * options is still an OPT */
+    if rdata == nil {
+        rdata = new(Unknown)
+    } else if rdlen == 0 && rr.Type != TypeOPT {
+        return end, nil
+    }
+
+    /* the rdata can't go past its length, but its names can still point
+     * back into the rest of the message */
+    n, err := rdata.Unpack(msg[:end], off)
+    if err != nil {
+        return off, fmt.Errorf("%w: %w", ErrBadRData, err)
+    }
+
+    if n != end {
+        return off, fmt.Errorf("%w: %d bytes left over", ErrBadRData, end - n)
+    }
+
+    rr.RData = rdata
+
+    return end, nil
 }
 
 func NewAN(name []byte, class Class, ttl uint32, rd RData) *Record {
@@ -340,7 +609,7 @@ func NewAN(name []byte, class Class, ttl uint32, rd RData) *Record {
     }
 
     an := &Record{
-        Name:  name,
+        Name:  CanonicalName(name),
         Class: class,
         TTL:   ttl,
         RData: rd,
@@ -354,8 +623,26 @@ func NewAN(name []byte, class Class, ttl uint32, rd RData) *Record {
     case *AAAA:
         an.Type = TypeAAAA
 
+    case *CNAME:
+        an.Type = TypeCNAME
+
+    case *PTR:
+        an.Type = TypePTR
+
     case *HINFO:
         an.Type = TypeHINFO
+
+    case *TXT:
+        an.Type = TypeTXT
+
+    case *SRV:
+        an.Type = TypeSRV
+
+    case *NSEC:
+        an.Type = TypeNSEC
+
+    case *OPT:
+        an.Type = TypeOPT
     }
 
     return an
@@ -364,10 +651,17 @@ func NewAN(name []byte, class Class, ttl uint32, rd RData) *Record {
 type RData interface {
     Len() uint16
     String() string
+
+    /* appends the wire format, compressing names against the table */
+    Pack(b []byte, names map[string]int) ([]byte, error)
+
+    /* decodes from off up to the end of msg, which is cut right after the
+     * rdata, and returns the offset following what was decoded */
+    Unpack(msg []byte, off int) (int, error)
 }
 
 type A struct {
-    Addr net.IP `mdns:"a"`
+    Addr net.IP
 }
 
 func NewA(addr net.IP) *A {
@@ -382,8 +676,28 @@ func (rr *A) String() string {
     return rr.Addr.String()
 }
 
+func (rr *A) Pack(b []byte, names map[string]int) ([]byte, error) {
+    addr := rr.Addr.To4()
+    if addr == nil {
+        return nil, fmt.Errorf("invalid IPv4 address: %s", rr.Addr)
+    }
+
+    return append(b, addr...), nil
+}
+
+func (rr *A) Unpack(msg []byte, off int) (int, error) {
+    addr, off, err := UnpackBytes(msg, off, net.IPv4len)
+    if err != nil {
+        return off, fmt.Errorf("read: %w", err)
+    }
+
+    rr.Addr = net.IP(addr)
+
+    return off, nil
+}
+
 type CNAME struct {
-    CNAME []byte `mdns:"name"`
+    CNAME []byte
 }
 
 func NewCNAME(cname string) *CNAME {
@@ -398,8 +712,27 @@ func (rr *CNAME) String() string {
     return string(rr.CNAME)
 }
 
+func (rr *CNAME) Pack(b []byte, names map[string]int) ([]byte, error) {
+    return PackName(b, names, rr.CNAME)
+}
+
+func (rr *CNAME) Unpack(msg []byte, off int) (int, error) {
+    name, off, err := UnpackName(msg, off)
+    if err != nil {
+        return off, fmt.Errorf("name: %w", err)
+    }
+
+    rr.CNAME = name
+
+    return off, nil
+}
+
 type PTR struct {
-    PTRNAME []byte `mdns:"name"`
+    PTRNAME []byte
+}
+
+func NewPTR(ptrname string) *PTR {
+    return &PTR{ PTRNAME: []byte(ptrname) }
 }
 
 func (rr *PTR) Len() uint16 {
@@ -410,6 +743,21 @@ func (rr *PTR) String() string {
     return string(rr.PTRNAME)
 }
 
+func (rr *PTR) Pack(b []byte, names map[string]int) ([]byte, error) {
+    return PackName(b, names, rr.PTRNAME)
+}
+
+func (rr *PTR) Unpack(msg []byte, off int) (int, error) {
+    name, off, err := UnpackName(msg, off)
+    if err != nil {
+        return off, fmt.Errorf("name: %w", err)
+    }
+
+    rr.PTRNAME = name
+
+    return off, nil
+}
+
 type HINFO struct {
     CPU string
     OS  string
@@ -455,20 +803,101 @@ func (rr *HINFO) String() string {
     return "\"" + rr.CPU + "\" " + rr.OS + "\""
 }
 
+func (rr *HINFO) Pack(b []byte, names map[string]int) ([]byte, error) {
+    b, err := PackString(b, rr.CPU)
+    if err != nil {
+        return nil, fmt.Errorf("string: %s", err)
+    }
+
+    return PackString(b, rr.OS)
+}
+
+func (rr *HINFO) Unpack(msg []byte, off int) (int, error) {
+    cpu, off, err := UnpackString(msg, off)
+    if err != nil {
+        return off, fmt.Errorf("string: %w", err)
+    }
+
+    os, off, err := UnpackString(msg, off)
+    if err != nil {
+        return off, fmt.Errorf("string: %w", err)
+    }
+
+    rr.CPU = cpu
+    rr.OS  = os
+
+    return off, nil
+}
+
 type TXT struct {
-    TXT string
+    TXT []string
+}
+
+func NewTXT(txt []string) *TXT {
+    return &TXT{ TXT: txt }
 }
 
 func (rr *TXT) Len() uint16 {
-    return uint16(len(rr.TXT) + 1)
+    if len(rr.TXT) == 0 {
+        return uint16(1)
+    }
+
+    l := 0
+
+    for _, s := range rr.TXT {
+        l += len(s) + 1
+    }
+
+    return uint16(l)
 }
 
 func (rr *TXT) String() string {
-    return rr.TXT
+    var s []string
+
+    for _, txt := range rr.TXT {
+        s = append(s, "\"" + txt + "\"")
+    }
+
+    return strings.Join(s, " ")
+}
+
+func (rr *TXT) Pack(b []byte, names map[string]int) ([]byte, error) {
+    txt := rr.TXT
+
+    /* an empty TXT record still holds a single empty string */
+    if len(txt) == 0 {
+        txt = []string{ "" }
+    }
+
+    for _, str := range txt {
+        var err error
+
+        b, err = PackString(b, str)
+        if err != nil {
+            return nil, fmt.Errorf("string: %s", err)
+        }
+    }
+
+    return b, nil
+}
+
+func (rr *TXT) Unpack(msg []byte, off int) (int, error) {
+    for off < len(msg) {
+        s, n, err := UnpackString(msg, off)
+        if err != nil {
+            return off, fmt.Errorf("string: %w", err)
+        }
+
+        off = n
+
+        rr.TXT = append(rr.TXT, s)
+    }
+
+    return off, nil
 }
 
 type AAAA struct {
-    Addr net.IP `mdns:"aaaa"`
+    Addr net.IP
 }
 
 func NewAAAA(addr net.IP) *AAAA {
@@ -487,15 +916,44 @@ func (rr *AAAA) String() string {
     return rr.Addr.String()
 }
 
+func (rr *AAAA) Pack(b []byte, names map[string]int) ([]byte, error) {
+    addr := rr.Addr.To16()
+    if addr == nil {
+        return nil, fmt.Errorf("invalid IPv6 address: %s", rr.Addr)
+    }
+
+    return append(b, addr...), nil
+}
+
+func (rr *AAAA) Unpack(msg []byte, off int) (int, error) {
+    addr, off, err := UnpackBytes(msg, off, net.IPv6len)
+    if err != nil {
+        return off, fmt.Errorf("read: %w", err)
+    }
+
+    rr.Addr = net.IP(addr)
+
+    return off, nil
+}
+
 type SRV struct {
     Priority uint16
     Weight   uint16
     Port     uint16
-    Target   []byte `mdns:"name"`
+    Target   []byte
+}
+
+func NewSRV(priority, weight, port uint16, target string) *SRV {
+    return &SRV{
+        Priority: priority,
+        Weight:   weight,
+        Port:     port,
+        Target:   []byte(target),
+    }
 }
 
 func (rr *SRV) Len() uint16 {
-    return uint16(2 + 2 + 2 + len(rr.Target))
+    return uint16(2 + 2 + 2 + len(rr.Target) + 1)
 }
 
 func (rr *SRV) String() string {
@@ -503,16 +961,236 @@ func (rr *SRV) String() string {
                        rr.Priority, rr.Weight, rr.Port, rr.Target)
 }
 
+func (rr *SRV) Pack(b []byte, names map[string]int) ([]byte, error) {
+    b = PackUint16(b, rr.Priority)
+    b = PackUint16(b, rr.Weight)
+    b = PackUint16(b, rr.Port)
+
+    return PackName(b, names, rr.Target)
+}
+
+func (rr *SRV) Unpack(msg []byte, off int) (int, error) {
+    var fields [3]uint16
+
+    for i := range fields {
+        v, n, err := UnpackUint16(msg, off)
+        if err != nil {
+            return off, fmt.Errorf("read: %w", err)
+        }
+
+        fields[i] = v
+        off       = n
+    }
+
+    target, off, err := UnpackName(msg, off)
+    if err != nil {
+        return off, fmt.Errorf("name: %w", err)
+    }
+
+    rr.Priority = fields[0]
+    rr.Weight   = fields[1]
+    rr.Port     = fields[2]
+    rr.Target   = target
+
+    return off, nil
+}
+
+/* Multicast DNS only uses NSEC to tell which types exist for a name, so the
+ * next domain is the record's own name and the bitmap only covers the types
+ * below 256, RFC 6762 §6.1. */
+type NSEC struct {
+    NextDomain []byte
+    Types      []Type
+}
+
+func NewNSEC(name string, types []Type) *NSEC {
+    return &NSEC{ NextDomain: []byte(name), Types: types }
+}
+
+func (rr *NSEC) Len() uint16 {
+    return uint16(len(rr.NextDomain) + 1 + len(NSECBitmap(rr.Types)))
+}
+
+func (rr *NSEC) String() string {
+    s := []string{ string(rr.NextDomain) }
+
+    for _, t := range rr.Types {
+        s = append(s, t.String())
+    }
+
+    return strings.Join(s, " ")
+}
+
+func (rr *NSEC) Pack(b []byte, names map[string]int) ([]byte, error) {
+    b, err := PackName(b, names, rr.NextDomain)
+    if err != nil {
+        return nil, fmt.Errorf("name: %s", err)
+    }
+
+    return append(b, NSECBitmap(rr.Types)...), nil
+}
+
+func (rr *NSEC) Unpack(msg []byte, off int) (int, error) {
+    name, off, err := UnpackName(msg, off)
+    if err != nil {
+        return off, fmt.Errorf("name: %w", err)
+    }
+
+    rr.NextDomain = name
+
+    for off < len(msg) {
+        var block, bitmap []byte
+
+        block, off, err = UnpackBytes(msg, off, 2)
+        if err != nil {
+            return off, fmt.Errorf("read: %w", err)
+        }
+
+        bitmap, off, err = UnpackBytes(msg, off, int(block[1]))
+        if err != nil {
+            return off, fmt.Errorf("read: %w", err)
+        }
+
+        for i, v := range bitmap {
+            for bit := 0; bit < 8; bit++ {
+                if v & (0x80 >> uint(bit)) == 0 {
+                    continue
+                }
+
+                t := Type(int(block[0]) * 256 + i * 8 + bit)
+
+                rr.Types = append(rr.Types, t)
+            }
+        }
+    }
+
+    return off, nil
+}
+
+/* Returns the first window block of the type bitmap, RFC 4034 §4.1.2. */
+func NSECBitmap(types []Type) []byte {
+    var bitmap []byte
+
+    for _, t := range types {
+        if t >= 256 {
+            continue
+        }
+
+        i := int(t) / 8
+
+        for len(bitmap) <= i {
+            bitmap = append(bitmap, 0)
+        }
+
+        bitmap[i] |= 0x80 >> (t % 8)
+    }
+
+    if len(bitmap) == 0 {
+        return nil
+    }
+
+    return append([]byte{ 0, byte(len(bitmap)) }, bitmap...)
+}
+
+/* Opaque rdata of a type we don't know about, RFC 3597. */
+type Unknown struct {
+    Data []byte
+}
+
+func NewUnknown(data []byte) *Unknown {
+    return &Unknown{ Data: data }
+}
+
+func (rr *Unknown) Len() uint16 {
+    return uint16(len(rr.Data))
+}
+
+func (rr *Unknown) String() string {
+    if len(rr.Data) == 0 {
+        return "\\# 0"
+    }
+
+    return fmt.Sprintf("\\# %d %x", len(rr.Data), rr.Data)
+}
+
+func (rr *Unknown) Pack(b []byte, names map[string]int) ([]byte, error) {
+    return append(b, rr.Data...), nil
+}
+
+func (rr *Unknown) Unpack(msg []byte, off int) (int, error) {
+    data, off, err := UnpackBytes(msg, off, len(msg) - off)
+    if err != nil {
+        return off, fmt.Errorf("read: %w", err)
+    }
+
+    rr.Data = data
+
+    return off, nil
+}
+
+type Option struct {
+    Code uint16
+    Data []byte
+}
+
 type OPT struct {
-    Code   uint16
-    OptLen uint16
-    OPT    []byte `mdns:"opt"`
+    Options []Option
 }
 
 func (rr *OPT) Len() uint16 {
-    return uint16(len(rr.OPT))
+    l := 0
+
+    for _, o := range rr.Options {
+        l += 2 + 2 + len(o.Data)
+    }
+
+    return uint16(l)
 }
 
 func (rr *OPT) String() string {
-    return ""
+    var s []string
+
+    for _, o := range rr.Options {
+        s = append(s, fmt.Sprintf("%d:%x", o.Code, o.Data))
+    }
+
+    return strings.Join(s, " ")
+}
+
+func (rr *OPT) Pack(b []byte, names map[string]int) ([]byte, error) {
+    for _, o := range rr.Options {
+        b = PackUint16(b, o.Code)
+        b = PackUint16(b, uint16(len(o.Data)))
+        b = append(b, o.Data...)
+    }
+
+    return b, nil
+}
+
+func (rr *OPT) Unpack(msg []byte, off int) (int, error) {
+    for off < len(msg) {
+        var o Option
+
+        var l uint16
+        var err error
+
+        o.Code, off, err = UnpackUint16(msg, off)
+        if err != nil {
+            return off, fmt.Errorf("read: %w", err)
+        }
+
+        l, off, err = UnpackUint16(msg, off)
+        if err != nil {
+            return off, fmt.Errorf("read: %w", err)
+        }
+
+        o.Data, off, err = UnpackBytes(msg, off, int(l))
+        if err != nil {
+            return off, fmt.Errorf("read: %w", err)
+        }
+
+        rr.Options = append(rr.Options, o)
+    }
+
+    return off, nil
 }
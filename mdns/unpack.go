@@ -30,297 +30,228 @@
 
 package mdns
 
-import "bytes"
 import "encoding/binary"
+import "errors"
 import "fmt"
-import "io"
-import "net"
-import "reflect"
+
+type UnpackOptions struct {
+    /* on error, also return whatever was decoded before it */
+    Partial bool
+
+    /* fail on records of unknown types instead of keeping them opaque */
+    Strict bool
+}
 
 func Unpack(pkt []byte) (*Message, error) {
-    msg := new(Message)
+    return UnpackWith(pkt, UnpackOptions{})
+}
 
-    r := bytes.NewReader(pkt)
+func UnpackWith(pkt []byte, opts UnpackOptions) (*Message, error) {
+    msg := new(Message)
 
-    err := UnpackStruct(r, &msg.Header)
+    off, err := msg.Header.Unpack(pkt, 0)
     if err != nil {
-        return nil, fmt.Errorf("Could not unpack header: %s", err)
+        return nil, &DecodeError{ Section: SectionHeader, Err: err }
     }
 
-    for i := uint16(0); i < msg.Header.QDCount; i++ {
+    for i := 0; i < int(msg.Header.QDCount); i++ {
         qd := new(Question)
 
-        err := UnpackStruct(r, qd)
+        off, err = qd.Unpack(pkt, off)
         if err != nil {
-            return nil, fmt.Errorf("Could not unpack qd: %s", err)
+            err = &DecodeError{ Section: SectionQuestion, Index: i, Err: err }
+            return PartialMessage(msg, opts, err)
         }
 
         msg.Question = append(msg.Question, qd)
     }
 
-    for i := uint16(0); i < msg.Header.ANCount; i++ {
-        an := new(Record)
-
-        err := UnpackStruct(r, an)
-        if err != nil {
-            return nil, fmt.Errorf("Could not unpack an: %s", err)
-        }
-
-        msg.Answer = append(msg.Answer, an)
+    sections := []struct {
+        section Section
+        count   uint16
+        rrs     *[]*Record
+    }{
+        { SectionAnswer,     msg.Header.ANCount, &msg.Answer     },
+        { SectionAuthority,  msg.Header.NSCount, &msg.Authority  },
+        { SectionAdditional, msg.Header.ARCount, &msg.Additional },
     }
 
-    for i := uint16(0); i < msg.Header.NSCount; i++ {
-        an := new(Record)
+    for _, sec := range sections {
+        for i := 0; i < int(sec.count); i++ {
+            rr := new(Record)
 
-        err := UnpackStruct(r, an)
-        if err != nil {
-            return nil, fmt.Errorf("Could not unpack an: %s", err)
-        }
+            off, err = rr.Unpack(pkt, off)
 
-        msg.Authority = append(msg.Authority, an)
-    }
+            if _, ok := rr.RData.(*Unknown); ok && opts.Strict && err == nil {
+                err = fmt.Errorf("%w: %s", ErrUnknownType, rr.Type)
+            }
 
-    for i := uint16(0); i < msg.Header.ARCount; i++ {
-        ar := new(Record)
+            if err != nil {
+                err = &DecodeError{ Section: sec.section, Index: i, Err: err }
+                return PartialMessage(msg, opts, err)
+            }
 
-        err := UnpackStruct(r, ar)
-        if err != nil {
-            return nil, fmt.Errorf("Could not unpack ar: %s", err)
+            *sec.rrs = append(*sec.rrs, rr)
         }
-
-        msg.Additional = append(msg.Additional, ar)
     }
 
-    if r.Len() != 0 {
-        l    := r.Len()
-        rest := make([]byte, l)
-
-        io.ReadFull(r, rest)
-
-        return nil, fmt.Errorf("trailing data: %d %s %v", l, msg, rest)
+    if off != len(pkt) {
+        err = fmt.Errorf("%w: %d bytes", ErrTrailingData, len(pkt) - off)
+        return PartialMessage(msg, opts, err)
     }
 
     return msg, nil
 }
 
-func UnpackStruct(r io.Reader, data interface{}) error {
-    value := reflect.ValueOf(data).Elem()
-
-    for i := 0; i < value.NumField(); i++ {
-        field := value.Field(i)
-        kind  := field.Kind()
-        tag   := value.Type().Field(i).Tag
-
-        switch {
-        case tag == `mdns:"name"`:
-            name, err := UnpackName(r)
-            if err != nil {
-                return fmt.Errorf("name: %s", err)
-            }
-
-            field.SetBytes(name)
+/* Makes the header agree with the sections decoded so far. */
+func PartialMessage(msg *Message, opts UnpackOptions, err error) (*Message, error) {
+    if opts.Partial != true {
+        return nil, err
+    }
 
-        case tag == `mdns:"a"`:
-            var addr [4]byte
+    msg.Header.QDCount = uint16(len(msg.Question))
+    msg.Header.ANCount = uint16(len(msg.Answer))
+    msg.Header.NSCount = uint16(len(msg.Authority))
+    msg.Header.ARCount = uint16(len(msg.Additional))
 
-            err := binary.Read(r, binary.BigEndian, &addr)
-            if err != nil {
-                return fmt.Errorf("read: %s", err)
-            }
+    return msg, err
+}
 
-            ip := net.IP(addr[:]).To4()
+/* Returns true if the error left the message usable, that is if nothing but
+ * additional records or trailing junk was lost. */
+func IsPartialError(err error) bool {
+    var derr *DecodeError
 
-            field.Set(reflect.ValueOf(ip))
+    if errors.As(err, &derr) {
+        return derr.Section == SectionAdditional
+    }
 
-        case tag == `mdns:"aaaa"`:
-            var addr [16]byte
+    return errors.Is(err, ErrTrailingData)
+}
 
-            err := binary.Read(r, binary.BigEndian, &addr)
-            if err != nil {
-                return fmt.Errorf("read: %s", err)
-            }
+func UnpackUint8(msg []byte, off int) (uint8, int, error) {
+    if off + 1 > len(msg) {
+        return 0, off, ErrTruncated
+    }
 
-            ip := net.IP(addr[:]).To16()
+    return msg[off], off + 1, nil
+}
 
-            field.Set(reflect.ValueOf(ip))
+func UnpackUint16(msg []byte, off int) (uint16, int, error) {
+    if off + 2 > len(msg) {
+        return 0, off, ErrTruncated
+    }
 
-        case tag == `mdns:"opt"`:
-            optlen := value.FieldByName("OptLen").Uint()
-            opt := make([]byte, optlen)
+    return binary.BigEndian.Uint16(msg[off:]), off + 2, nil
+}
 
-            err := binary.Read(r, binary.BigEndian, &opt)
-            if err != nil {
-                return fmt.Errorf("read: %s", err)
-            }
+func UnpackUint32(msg []byte, off int) (uint32, int, error) {
+    if off + 4 > len(msg) {
+        return 0, off, ErrTruncated
+    }
 
-            field.Set(reflect.ValueOf(opt))
+    return binary.BigEndian.Uint32(msg[off:]), off + 4, nil
+}
 
-        case tag == `mdns:"rdata"`:
-            rdlen := value.FieldByName("RDLen").Uint()
+/* Returns a copy of the next n bytes. */
+func UnpackBytes(msg []byte, off, n int) ([]byte, int, error) {
+    if n < 0 || off + n > len(msg) {
+        return nil, off, ErrTruncated
+    }
 
-            if rdlen == 0 {
-                continue
-            }
+    b := make([]byte, n)
+    copy(b, msg[off:])
 
-            rdtype := value.FieldByName("Type").Interface().(Type)
-            rdata  := rdtype.MakeRR()
-            if rdata == nil {
-                return fmt.Errorf("%d not implemented",
-                    rdtype)
-            }
+    return b, off + n, nil
+}
 
-            err := UnpackStruct(r, rdata)
-            if err != nil {
-                return fmt.Errorf("struct: %s", err)
-            }
+/* Compression pointers are followed within the whole message, the returned
+ * offset is the one right after the name where it first appears. Each
+ * pointer must go back to before the part of the name decoded so far, which
+ * rules out loops. */
+func UnpackName(msg []byte, off int) ([]byte, int, error) {
+    var name []byte
 
-            field.Set(reflect.ValueOf(rdata))
+    start := off
+    floor := off
+    next  := -1
+    wire  := 1
 
-        case kind == reflect.Uint16:
-            var v uint16
+    for {
+        v, n, err := UnpackUint8(msg, off)
+        if err != nil {
+            return nil, off, fmt.Errorf("read: %w", err)
+        }
 
-            err := binary.Read(r, binary.BigEndian, &v)
+        if v & 0xC0 == 0xC0 {
+            p, n, err := UnpackUint8(msg, n)
             if err != nil {
-                return fmt.Errorf("read: %s", err)
+                return nil, off, fmt.Errorf("read: %w", err)
             }
 
-            field.SetUint(uint64(v))
+            ptr := int(v ^ 0xC0) << 8 | int(p)
 
-        case kind == reflect.Uint32:
-            var v uint32
-
-            err := binary.Read(r, binary.BigEndian, &v)
-            if err != nil {
-                return fmt.Errorf("read: %s", err)
+            if ptr >= off {
+                return nil, off, &NameError{ Off: start, Err: ErrForwardPointer }
             }
 
-            field.SetUint(uint64(v))
-
-        case kind == reflect.String:
-            s, err := UnpackString(r)
-            if err != nil {
-                return fmt.Errorf("string: %s", err)
+            if ptr >= floor {
+                return nil, off, &NameError{ Off: start, Err: ErrPointerLoop }
             }
 
-            field.SetString(s)
-
-        case kind == reflect.Interface || kind == reflect.Struct:
-            err := UnpackStruct(r, field.Interface())
-            if err != nil {
-                return fmt.Errorf("struct: %s", err)
+            if next < 0 {
+                next = n
             }
-        }
-    }
-
-    return nil
-}
-
-func UnpackName(r io.Reader) ([]byte, error) {
-    var name []byte
-
-    for {
-        var v uint8
 
-        err := binary.Read(r, binary.BigEndian, &v)
-        if err != nil {
-            return nil, fmt.Errorf("read: %s", err)
+            off   = ptr
+            floor = ptr
+            continue
         }
 
-        if v&0xC0 == 0xC0 {
-            var p uint8
-
-            err := binary.Read(r, binary.BigEndian, &p)
-            if err != nil {
-                return nil, fmt.Errorf("read: %s", err)
-            }
-
-            off := (int(v)^0xC0)<<8 | int(p)
-
-            return UnpackNameAt(r.(*bytes.Reader), int64(off))
+        /* the 01 and 10 prefixes are for extended label types */
+        if v & 0xC0 != 0 {
+            return nil, off, &NameError{ Off: start, Err: ErrLabelTooLong }
         }
 
         if v == 0 {
+            off = n
             break
         }
 
-        label := make([]byte, v)
+        wire += 1 + int(v)
 
-        err = binary.Read(r, binary.BigEndian, &label)
-        if err != nil {
-            return nil, fmt.Errorf("read: %s", err)
+        if wire > maxNameLen {
+            return nil, off, &NameError{ Off: start, Err: ErrNameTooLong }
         }
 
-        name = append(name, label...)
-        name = append(name, '.')
-    }
-
-    return name, nil
-}
-
-func UnpackNameAt(r io.ReaderAt, off int64) ([]byte, error) {
-    var name []byte
-
-    for {
-        v := make([]byte, 1)
-
-        n, err := r.ReadAt(v, off)
+        label, n, err := UnpackBytes(msg, n, int(v))
         if err != nil {
-            return nil, fmt.Errorf("read at: %s", err)
+            return nil, off, fmt.Errorf("read: %w", err)
         }
 
-        off += int64(n)
+        off = n
 
-        if v[0]&0xC0 == 0xC0 {
-            p := make([]byte, 1)
-
-            _, err := r.ReadAt(p, off)
-            if err != nil {
-                return nil, fmt.Errorf("read at: %s", err)
-            }
-
-            off := (int(v[0])^0xC0)<<8 | int(p[0])
-
-            return UnpackNameAt(r, int64(off))
-        }
-
-        if v[0] == 0 {
-            break
-        }
-
-        label := make([]byte, v[0])
-
-        n, err = r.ReadAt(label, off)
-        if err != nil {
-            return nil, fmt.Errorf("read at: %s", err)
-        }
-
-        off += int64(n)
-
-        name = append(name, label...)
+        name = append(name, EscapeLabel(label)...)
         name = append(name, '.')
     }
 
-    return name, nil
-}
+    if next >= 0 {
+        off = next
+    }
 
-func UnpackString(r io.Reader) (string, error) {
-    var v uint8
+    return name, off, nil
+}
 
-    err := binary.Read(r, binary.BigEndian, &v)
+func UnpackString(msg []byte, off int) (string, int, error) {
+    l, off, err := UnpackUint8(msg, off)
     if err != nil {
-        return "", fmt.Errorf("read: %s", err)
+        return "", off, fmt.Errorf("read: %w", err)
     }
 
-    if v == 0 {
-        return "", nil
-    }
-
-    s := make([]byte, v)
-
-    err = binary.Read(r, binary.BigEndian, &s)
+    s, off, err := UnpackBytes(msg, off, int(l))
     if err != nil {
-        return "", fmt.Errorf("read: %s", err)
+        return "", off, fmt.Errorf("read: %w", err)
     }
 
-    return string(s), nil
+    return string(s), off, nil
 }
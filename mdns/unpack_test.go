@@ -0,0 +1,131 @@
+/*
+ * Minimal multicast DNS server.
+ *
+ * Copyright (c) 2014, Alessandro Ghedini
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are
+ * met:
+ *
+ *     * Redistributions of source code must retain the above copyright
+ *       notice, this list of conditions and the following disclaimer.
+ *
+ *     * Redistributions in binary form must reproduce the above copyright
+ *       notice, this list of conditions and the following disclaimer in the
+ *       documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS
+ * IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO,
+ * THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR
+ * PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR
+ * CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL,
+ * EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+ * PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+ * PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF
+ * LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING
+ * NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+ * SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package mdns
+
+import "bytes"
+import "errors"
+import "net"
+import "testing"
+
+/* a header with a single question, the question name must follow */
+var question = []byte{ 0, 0, 0, 0, 0, 1, 0, 0, 0, 0, 0, 0 }
+
+func MakeQuestion(name []byte) []byte {
+    pkt := append(append([]byte{}, question...), name...)
+
+    return append(pkt, 0, byte(TypeA), 0, byte(ClassInet))
+}
+
+func MakeName(lens ...int) []byte {
+    var name []byte
+
+    for _, l := range lens {
+        name = append(name, byte(l))
+        name = append(name, bytes.Repeat([]byte{ 'a' }, l)...)
+    }
+
+    return append(name, 0)
+}
+
+var unpackTests = []struct {
+    name string
+    pkt  []byte
+    err  error
+}{
+    /* "a" followed by a pointer back to itself */
+    { "pointer loop", MakeQuestion([]byte{ 1, 'a', 0xC0, 12 }), ErrPointerLoop },
+
+    { "forward pointer", MakeQuestion([]byte{ 0xC0, 20 }), ErrForwardPointer },
+
+    { "64 octet label", MakeQuestion(MakeName(64)), ErrLabelTooLong },
+
+    { "256 octet name", MakeQuestion(MakeName(63, 63, 63, 62)), ErrNameTooLong },
+
+    { "truncated", question, ErrTruncated },
+}
+
+func TestUnpackErrors(t *testing.T) {
+    for _, test := range unpackTests {
+        _, err := Unpack(test.pkt)
+
+        if errors.Is(err, test.err) != true {
+            t.Errorf("%s: expected '%s', got '%v'", test.name, test.err, err)
+        }
+
+        var de *DecodeError
+
+        if errors.As(err, &de) != true || de.Section != SectionQuestion {
+            t.Errorf("%s: expected question decode error, got '%v'",
+                     test.name, err)
+        }
+    }
+}
+
+func FuzzUnpack(f *testing.F) {
+    msg := new(Message)
+
+    msg.Header.Flags |= FlagQR
+
+    msg.AppendQD(NewQD([]byte("host.local."), TypeA, ClassInet))
+    msg.AppendAN(NewAN([]byte("host.local."), ClassInet, 120,
+                       NewA(net.IPv4(192, 0, 2, 1))))
+    msg.AppendAN(NewAN([]byte("_http._tcp.local."), ClassInet, 4500,
+                       NewPTR("Web\\.1._http._tcp.local.")))
+    msg.AppendAR(NewAN([]byte("host.local."), ClassInet, 120,
+                       NewNSEC("host.local.", []Type{ TypeA })))
+    msg.AppendAR(NewEDNS(1232, 0, false))
+
+    pkt, err := Pack(msg)
+    if err != nil {
+        f.Fatalf("Could not pack message: %s", err)
+    }
+
+    f.Add(pkt)
+
+    for _, test := range unpackTests {
+        f.Add(test.pkt)
+    }
+
+    f.Fuzz(func(t *testing.T, pkt []byte) {
+        UnpackWith(pkt, UnpackOptions{ Partial: true })
+
+        msg, err := Unpack(pkt)
+        if err != nil {
+            return
+        }
+
+        /* whatever decodes must encode again */
+        _, err = Pack(msg)
+        if err != nil {
+            t.Fatalf("Could not pack unpacked message: %s", err)
+        }
+    })
+}
@@ -143,3 +143,11 @@ func IsRelevant(msg *syscall.IfAddrmsg) bool {
 
     return false
 }
+
+func IsLinkLocal(msg *syscall.IfAddrmsg) bool {
+    if msg.Scope == syscall.RT_SCOPE_LINK {
+        return true
+    }
+
+    return false
+}